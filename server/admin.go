@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+)
+
+// admin routes are for the maintainer only, guarded by a bearer token from ADMIN_TOKEN
+// unlike the metrics token an unset admin token doesn't leave the routes open, it switches them off
+func requireAdminToken(token string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				writeError(w, http.StatusNotFound, "not_found", "Wallify Server: Page not found")
+				return
+			}
+			given := []byte(r.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(given, []byte("Bearer "+token)) != 1 {
+				writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid or missing admin token")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// revoke a session on the running server, the delete goes through its token cache so the key stops working straight
+// away rather than after TOKEN_CACHE_TTL, the admin commands call this when ADMIN_SERVER_URL is set
+// like the DynamoDB delete underneath it's fine to revoke a key that's already gone
+func handleAdminRevokeSession(w http.ResponseWriter, r *http.Request) {
+	tokenKey := r.PathValue("key")
+	if err := tokens.Delete(r.Context(), tokenKey); err != nil {
+		log.Printf("Error revoking session %s: %v", maskToken(tokenKey), err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error revoking session")
+		return
+	}
+	activeSessions.forget(tokenKey)
+	log.Printf("Session %s revoked by admin", maskToken(tokenKey))
+	w.WriteHeader(http.StatusNoContent)
+}
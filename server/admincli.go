@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// maintenance commands run through the server binary, i.e. `./main admin users list` or `go run . admin -json stats`
+// they go through the same TokenStore and UserStore as the server, so they work against whatever DynamoDB the
+// environment points at, including DynamoDB Local through DYNAMO_ENDPOINT
+// a running server caches token lookups for TOKEN_CACHE_TTL, so with ADMIN_SERVER_URL (and ADMIN_TOKEN) set sessions are
+// revoked through the server's admin route instead, which clears its cache as well, without it a revoked session can
+// keep working on the server for that long
+
+const adminUsage = `usage: main admin [-json] <command>
+
+commands:
+  users list
+  users show <user id>
+  users delete <user id>            removes the user with their sessions, waitlist entry, presets, shares and feeds
+  users migrate-pii [-dry-run]      rewrites existing users to what PRIVACY_MODE keeps
+  sessions list [-user <user id>]
+  sessions revoke <token key>
+  tokens purge-expired [-max-idle 720h] [-dry-run]
+  stats [-days 30]
+  stats rebuild                     recomputes the user counters from the users table
+`
+
+// run an admin command, returning the exit code
+func runAdmin(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("admin", flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, adminUsage) }
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	cmd := adminCommand{out: out, json: *asJSON}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	var err error
+	switch command := args[0]; {
+	case command == "users" && len(args) == 2 && args[1] == "list":
+		err = cmd.usersList(ctx)
+	case command == "users" && len(args) == 3 && args[1] == "show":
+		err = cmd.usersShow(ctx, args[2])
+	case command == "users" && len(args) == 3 && args[1] == "delete":
+		err = cmd.usersDelete(ctx, args[2])
+	case command == "users" && len(args) >= 2 && args[1] == "migrate-pii":
+		err = cmd.usersMigratePII(ctx, args[2:])
+	case command == "sessions" && len(args) >= 2 && args[1] == "list":
+		err = cmd.sessionsList(ctx, args[2:])
+	case command == "sessions" && len(args) == 3 && args[1] == "revoke":
+		err = cmd.sessionsRevoke(ctx, args[2])
+	case command == "tokens" && len(args) >= 2 && args[1] == "purge-expired":
+		err = cmd.tokensPurgeExpired(ctx, args[2:])
+	case command == "stats" && len(args) == 2 && args[1] == "rebuild":
+		err = cmd.statsRebuild(ctx)
+	case command == "stats":
+		err = cmd.stats(ctx, args[1:])
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+type adminCommand struct {
+	out  io.Writer
+	json bool
+}
+
+// print v as JSON, or the header and rows as an aligned table
+func (c adminCommand) print(v interface{}, header []string, rows [][]string) error {
+	if c.json {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, cell)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (c adminCommand) usersList(ctx context.Context) error {
+	list, err := users.List(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	rows := make([][]string, 0, len(list))
+	for _, user := range list {
+		rows = append(rows, []string{user.ID, user.DisplayName, displayEmail(user), user.Country, formatTime(user.CreatedAt)})
+	}
+	return c.print(list, []string{"ID", "NAME", "EMAIL", "COUNTRY", "CREATED"}, rows)
+}
+
+func (c adminCommand) usersShow(ctx context.Context, userID string) error {
+	user, err := users.Get(ctx, userID)
+	if err != nil {
+		return err
+	}
+	sessions, err := sessionsFor(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	rows := [][]string{
+		{"id", user.ID},
+		{"name", user.DisplayName},
+		{"email", displayEmail(user)},
+		{"country", user.Country},
+		{"created", formatTime(user.CreatedAt)},
+		{"sessions", strconv.Itoa(len(sessions))},
+	}
+	return c.print(map[string]interface{}{"user": user, "sessions": sessions}, []string{"FIELD", "VALUE"}, rows)
+}
+
+func (c adminCommand) usersDelete(ctx context.Context, userID string) error {
+	user, err := users.Get(ctx, userID)
+	if err != nil {
+		return err
+	}
+	deletion, err := deleteUserData(ctx, user, "admin", "")
+	if err != nil {
+		return err
+	}
+	warnIfCached(deletion.Sessions)
+	return c.print(deletion, []string{"DELETED", "SESSIONS", "WAITLIST ENTRIES", "PRESETS", "SHARES", "FEEDS"},
+		[][]string{{userID, strconv.Itoa(deletion.Sessions), strconv.Itoa(deletion.WaitlistEntries),
+			strconv.Itoa(deletion.Presets), strconv.Itoa(deletion.Shares), strconv.Itoa(deletion.Feeds)}})
+}
+
+// the email, or the start of its hash for users stored in privacy mode
+func displayEmail(user *User) string {
+	if user.Email == "" && len(user.EmailHash) >= 12 {
+		return "hash:" + user.EmailHash[:12]
+	}
+	return user.Email
+}
+
+// one-off rewrite of users stored before privacy mode was turned on, dropping the email (for its hash), the country
+// and, if configured, the display name
+// the user counters are rebuilt first so the countries are in the per-country counts before they're dropped
+// users already in shape are left alone, so running it again is harmless
+func (c adminCommand) usersMigratePII(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("users migrate-pii", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list the users that would change")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !privacy.enabled {
+		return errors.New("PRIVACY_MODE is off, turn it on (with an EMAIL_HASH_KEY) before migrating")
+	}
+
+	if !*dryRun {
+		if _, err := rebuildUserStats(ctx); err != nil {
+			return fmt.Errorf("error counting countries before migrating: %w", err)
+		}
+	}
+	list, err := users.List(ctx)
+	if err != nil {
+		return err
+	}
+	migrated := []string{}
+	for _, user := range list {
+		if user.Email == "" && user.Country == "" && (!privacy.skipDisplayNames || user.DisplayName == "") {
+			continue
+		}
+		migrated = append(migrated, user.ID)
+		if *dryRun {
+			continue
+		}
+
+		minimizeUser(user)
+		if err := users.Put(ctx, user); err != nil {
+			return fmt.Errorf("migrated %d users before failing: %w", len(migrated)-1, err)
+		}
+	}
+
+	rows := make([][]string, 0, len(migrated))
+	for _, id := range migrated {
+		rows = append(rows, []string{id})
+	}
+	return c.print(map[string]interface{}{"migrated": migrated, "dryRun": *dryRun}, []string{"MIGRATED"}, rows)
+}
+
+// what the admin commands show for a session, never the Spotify tokens themselves
+type sessionInfo struct {
+	TokenKey string    `json:"tokenKey"`
+	UserID   string    `json:"userId"`
+	IssuedAt time.Time `json:"issuedAt"` // when the access token was last issued, at login or on refresh
+}
+
+func sessionsFor(ctx context.Context, userID string) ([]sessionInfo, error) {
+	list, err := tokens.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []sessionInfo{}
+	for _, token := range list {
+		if userID == "" || token.UserID == userID {
+			sessions = append(sessions, sessionInfo{token.TokenID, token.UserID, time.Unix(token.Expiration, 0).UTC()})
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].IssuedAt.After(sessions[j].IssuedAt) })
+	return sessions, nil
+}
+
+func (c adminCommand) sessionsList(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("sessions list", flag.ContinueOnError)
+	userID := flags.String("user", "", "only sessions belonging to this user ID")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	sessions, err := sessionsFor(ctx, *userID)
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(sessions))
+	for _, session := range sessions {
+		owner := session.UserID
+		if owner == "" {
+			owner = "-"
+		}
+		rows = append(rows, []string{session.TokenKey, owner, formatTime(&session.IssuedAt)})
+	}
+	return c.print(sessions, []string{"TOKEN KEY", "USER", "ISSUED"}, rows)
+}
+
+// deletes made by the admin commands, sent to the running server so its token cache forgets them too
+// everything else reads and writes the store directly like the rest of the commands
+type serverRevokingTokenStore struct {
+	TokenStore
+	serverURL  string
+	adminToken string
+	client     *http.Client
+}
+
+func revokeThroughServer(next TokenStore, serverURL, adminToken string) TokenStore {
+	if serverURL == "" {
+		return next
+	}
+	return &serverRevokingTokenStore{
+		TokenStore: next,
+		serverURL:  strings.TrimSuffix(serverURL, "/"),
+		adminToken: adminToken,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *serverRevokingTokenStore) Delete(ctx context.Context, tokenKey string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", s.serverURL+apiPrefix+"/admin/sessions/"+url.PathEscape(tokenKey), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.adminToken)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error revoking session through the server: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("error revoking session through the server: %s", resp.Status)
+	}
+	return nil
+}
+
+// let the maintainer know a revocation only reached the store
+func warnIfCached(revoked int) {
+	if _, ok := tokens.(*serverRevokingTokenStore); !ok && revoked > 0 {
+		fmt.Fprintln(os.Stderr, "note: ADMIN_SERVER_URL isn't set, a running server may accept revoked sessions until its token cache expires")
+	}
+}
+
+func (c adminCommand) sessionsRevoke(ctx context.Context, tokenKey string) error {
+	if _, err := tokens.Fetch(ctx, tokenKey); err != nil {
+		return err
+	}
+	if err := tokens.Delete(ctx, tokenKey); err != nil {
+		return err
+	}
+	warnIfCached(1)
+	return c.print(map[string]string{"revoked": tokenKey}, []string{"REVOKED"}, [][]string{{tokenKey}})
+}
+
+// sessions whose access token hasn't been issued or refreshed in max-idle, an active session refreshes at least hourly
+// feed sessions are left alone however idle they look, a feed only refreshes when its top items are due and deleting
+// its session would quietly break the wallpaper url, revoking the feed removes the session with it
+func (c adminCommand) tokensPurgeExpired(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("tokens purge-expired", flag.ContinueOnError)
+	maxIdle := flags.Duration("max-idle", 30*24*time.Hour, "purge sessions not refreshed in this long")
+	dryRun := flags.Bool("dry-run", false, "only list what would be purged")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *maxIdle <= 0 {
+		return errors.New("-max-idle must be positive")
+	}
+
+	sessions, err := sessionsFor(ctx, "")
+	if err != nil {
+		return err
+	}
+	list, err := feeds.List(ctx)
+	if err != nil {
+		return err
+	}
+	feedSessions := make(map[string]bool, len(list))
+	for _, feed := range list {
+		feedSessions[feed.TokenKey] = true
+	}
+	cutoff := time.Now().Add(-*maxIdle)
+	purged := []sessionInfo{}
+	for _, session := range sessions {
+		if session.IssuedAt.After(cutoff) || feedSessions[session.TokenKey] {
+			continue
+		}
+		if !*dryRun {
+			if err := tokens.Delete(ctx, session.TokenKey); err != nil {
+				return fmt.Errorf("purged %d sessions before failing: %w", len(purged), err)
+			}
+		}
+		purged = append(purged, session)
+	}
+	if !*dryRun {
+		warnIfCached(len(purged))
+	}
+
+	rows := make([][]string, 0, len(purged))
+	for _, session := range purged {
+		rows = append(rows, []string{session.TokenKey, formatTime(&session.IssuedAt)})
+	}
+	return c.print(map[string]interface{}{"purged": purged, "dryRun": *dryRun}, []string{"PURGED", "ISSUED"}, rows)
+}
+
+// usage stats from the counters, the same report as /admin/stats minus the live session count, which only the
+// running server knows
+func (c adminCommand) stats(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	days := flags.Int("days", 30, "size of the window in days, ending today")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if _, err := parseStatsDays(strconv.Itoa(*days)); err != nil {
+		return err
+	}
+
+	report, err := buildStatsReport(ctx, *days, time.Now())
+	if err != nil {
+		return err
+	}
+
+	rows := [][]string{
+		{"window", report.From + " to " + report.To},
+		{"users", strconv.FormatInt(report.Users, 10)},
+		{"new users", strconv.FormatInt(report.NewUsers, 10)},
+		{"deleted users", strconv.FormatInt(report.DeletedUsers, 10)},
+		{"returning logins", strconv.FormatInt(report.ReturningLogins, 10)},
+	}
+	for _, week := range report.NewPerWeek {
+		rows = append(rows, []string{"new users " + week.Period, strconv.FormatInt(week.Count, 10)})
+	}
+	for _, day := range report.ActivePerDay {
+		if day.Count > 0 {
+			rows = append(rows, []string{"active sessions " + day.Period, strconv.FormatInt(day.Count, 10)})
+		}
+	}
+	rows = append(rows, sortedCounts("country ", report.Countries)...)
+	rows = append(rows, sortedCounts("tier ", report.Products)...)
+	return c.print(report, []string{"STAT", "VALUE"}, rows)
+}
+
+func sortedCounts(prefix string, counts map[string]int64) [][]string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	rows := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		rows = append(rows, []string{prefix + key, strconv.FormatInt(counts[key], 10)})
+	}
+	return rows
+}
+
+func (c adminCommand) statsRebuild(ctx context.Context) error {
+	counters, err := rebuildUserStats(ctx)
+	if err != nil {
+		return err
+	}
+	rows := sortedCounts("", counters)
+	return c.print(counters, []string{"COUNTER", "VALUE"}, rows)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// append-only record of sensitive operations, i.e. a user deleting their data, kept in its own table so it outlives
+// whatever it describes
+
+type auditEntry struct {
+	Action  string            // what happened, i.e. user.deleted
+	Actor   string            // who did it, self for the user themselves or admin for the admin commands
+	Subject string            // who or what it happened to, i.e. the Spotify user ID
+	Details map[string]string // anything else worth keeping, never personal data
+}
+
+type auditStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+var audit *auditStore
+
+func (s *auditStore) Record(ctx context.Context, entry auditEntry) error {
+	// ids sort by time, the random suffix keeps two entries in the same nanosecond apart
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Errorf("error generating audit id: %w", err)
+	}
+	now := time.Now()
+
+	item := map[string]types.AttributeValue{
+		"AuditID": &types.AttributeValueMemberS{Value: fmt.Sprintf("%019d-%s", now.UnixNano(), hex.EncodeToString(suffix))},
+		"Action":  &types.AttributeValueMemberS{Value: entry.Action},
+		"Actor":   &types.AttributeValueMemberS{Value: entry.Actor},
+		"Subject": &types.AttributeValueMemberS{Value: entry.Subject},
+		"At":      &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+	}
+	if len(entry.Details) > 0 {
+		details := make(map[string]types.AttributeValue, len(entry.Details))
+		for k, v := range entry.Details {
+			details[k] = &types.AttributeValueMemberS{Value: v}
+		}
+		item["Details"] = &types.AttributeValueMemberM{Value: details}
+	}
+
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("error writing audit entry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// compact, grid oriented shape for a top artist or track
+// the raw Spotify objects carry available markets, external urls, preview urls, etc. that the grid never uses
+type contentItem struct {
+	ID      string         `json:"id"`
+	Name    string         `json:"name"`
+	URI     string         `json:"uri"`
+	Rank    int            `json:"rank"`
+	Artists []artistRef    `json:"artists,omitempty"` // tracks only
+	Album   string         `json:"album,omitempty"`   // tracks only
+	Images  []imageEntry   `json:"images"`            // largest first
+	Image   *imageEntry    `json:"image"`             // best fit for the requested tile size, nil if there are no images
+	Palette []paletteColor `json:"palette,omitempty"` // only with ?palette=true or a color ?order=
+}
+
+type artistRef struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type imageEntry struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// response views, compact is the default and full passes the raw Spotify items through untouched
+const (
+	viewCompact = "compact"
+	viewFull    = "full"
+)
+
+func parseView(v string) (string, error) {
+	switch v {
+	case "", viewCompact:
+		return viewCompact, nil
+	case viewFull:
+		return viewFull, nil
+	}
+	return "", fmt.Errorf("view must be %q or %q", viewCompact, viewFull)
+}
+
+// read the optional tile_px hint, 0 means no hint and the largest image is picked
+func parseTilePx(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maxTilePx {
+		return 0, fmt.Errorf("tile_px must be between 1 and %d", maxTilePx)
+	}
+	return n, nil
+}
+
+// 8K is already well past any single grid tile
+const maxTilePx = 8192
+
+// convert raw Spotify items into the compact shape, ranks continue on from the offset the items were fetched at
+// artists carry their own images, tracks don't so the album art is used instead
+func compactContent(items []map[string]interface{}, offset, tilePx int) []contentItem {
+	compact := make([]contentItem, 0, len(items))
+	for i, item := range items {
+		entry := contentItem{
+			ID:     stringField(item, "id"),
+			Name:   stringField(item, "name"),
+			URI:    stringField(item, "uri"),
+			Rank:   offset + i + 1,
+			Images: parseImages(item["images"]),
+		}
+
+		if album, ok := item["album"].(map[string]interface{}); ok {
+			entry.Album = stringField(album, "name")
+			entry.Images = parseImages(album["images"])
+		}
+
+		if artists, ok := item["artists"].([]interface{}); ok {
+			for _, a := range artists {
+				if artist, ok := a.(map[string]interface{}); ok {
+					entry.Artists = append(entry.Artists, artistRef{
+						ID:   stringField(artist, "id"),
+						Name: stringField(artist, "name"),
+					})
+				}
+			}
+		}
+
+		entry.Image = pickImage(entry.Images, tilePx)
+		compact = append(compact, entry)
+	}
+	return compact
+}
+
+// parse a Spotify image array, sorted largest first since Spotify doesn't guarantee the order
+// some images come back without dimensions, those sort last
+func parseImages(raw interface{}) []imageEntry {
+	images := []imageEntry{}
+	list, ok := raw.([]interface{})
+	if !ok {
+		return images
+	}
+
+	for _, i := range list {
+		image, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		url := stringField(image, "url")
+		if url == "" {
+			continue
+		}
+		width, _ := image["width"].(float64)
+		height, _ := image["height"].(float64)
+		images = append(images, imageEntry{URL: url, Width: int(width), Height: int(height)})
+	}
+
+	sort.SliceStable(images, func(a, b int) bool {
+		return images[a].Width > images[b].Width
+	})
+	return images
+}
+
+// pick the smallest image that still covers a tile of tilePx, or the largest available if none do
+// tiles are square so an image only covers one if its shorter side does, images without dimensions are only used as a last resort
+func pickImage(images []imageEntry, tilePx int) *imageEntry {
+	if len(images) == 0 {
+		return nil
+	}
+
+	best := images[0] // largest first
+	if tilePx <= 0 {
+		return &best
+	}
+
+	for _, image := range images {
+		size := min(image.Width, image.Height)
+		if size >= tilePx && size < min(best.Width, best.Height) {
+			best = image
+		}
+	}
+	return &best
+}
+
+func stringField(m map[string]interface{}, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
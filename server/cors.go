@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORS settings, loaded from the environment so the API can be locked to the production site and its preview deployments
+type corsConfig struct {
+	AllowedOrigins   []string // exact origins, "*" for any, or a single wildcard i.e. https://wallify-*.vercel.app
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	MaxAge           int // seconds browsers may cache a preflight
+}
+
+// any origin with credentials would let every site make credentialed requests, since the origin is echoed back rather
+// than sent as a literal *, so that combination stops the server instead
+func loadCorsConfig() corsConfig {
+	cfg := corsConfig{
+		AllowedOrigins:   envList("CORS_ALLOWED_ORIGINS", []string{"https://wallify.doypid.com", "http://localhost:3000"}),
+		AllowedMethods:   envList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "DELETE"}),
+		AllowedHeaders:   envList("CORS_ALLOWED_HEADERS", []string{"Content-Type", "x-token-key"}),
+		AllowCredentials: envBool("CORS_ALLOW_CREDENTIALS", false),
+		MaxAge:           envInt("CORS_MAX_AGE", 86400),
+	}
+	if cfg.AllowCredentials {
+		for _, origin := range cfg.AllowedOrigins {
+			if origin == "*" {
+				log.Fatal("CORS_ALLOWED_ORIGINS=* can't be combined with CORS_ALLOW_CREDENTIALS=true, list the origins instead")
+			}
+		}
+	}
+	return cfg
+}
+
+// check an Origin header against the allowlist
+func (c corsConfig) allowOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		// the wildcard only stands in for part of the host, never a scheme, port or path
+		if before, after, ok := strings.Cut(allowed, "*"); ok &&
+			len(origin) > len(before)+len(after) &&
+			strings.HasPrefix(origin, before) && strings.HasSuffix(origin, after) &&
+			!strings.ContainsAny(origin[len(before):len(origin)-len(after)], "/:") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c corsConfig) allowMethod(method string) bool {
+	for _, allowed := range c.AllowedMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// set the CORS headers for allowed origins and answer preflight requests before they reach the router
+// responses depend on the Origin header so they're always marked Vary: Origin, otherwise a shared cache could serve
+// one origin's Access-Control-Allow-Origin to another
+func withCors(cfg corsConfig) middleware {
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	headers := strings.Join(cfg.AllowedHeaders, ", ")
+	maxAge := strconv.Itoa(cfg.MaxAge)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Add("Vary", "Origin")
+
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+			// not a cross-origin request, nothing to add
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !cfg.allowOrigin(origin) {
+				if preflight {
+					writeError(w, http.StatusForbidden, "cors_forbidden", "Origin "+origin+" is not allowed")
+					return
+				}
+				// leave the CORS headers off, the browser will refuse to hand the response to the page
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h.Set("Access-Control-Allow-Origin", origin)
+			if cfg.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if !preflight {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			if !cfg.allowMethod(r.Header.Get("Access-Control-Request-Method")) {
+				writeError(w, http.StatusForbidden, "cors_forbidden", "Method "+r.Header.Get("Access-Control-Request-Method")+" is not allowed")
+				return
+			}
+			h.Set("Access-Control-Allow-Methods", methods)
+			h.Set("Access-Control-Allow-Headers", headers)
+			h.Set("Access-Control-Max-Age", maxAge)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
@@ -37,7 +37,8 @@ ssh -vvv -i "./wallify-dev.pem" ec2-user@ec2-18-215-27-1.compute-1.amazonaws.com
 
   # stop and remove any existing docker containers
   echo "Stopping and removing existing containers..."
-  docker stop $(docker ps -q) && docker rm $(docker ps -aq)
+  # give the server time to drain in-flight requests, it shuts down gracefully on SIGTERM
+  docker stop -t 30 $(docker ps -q) && docker rm $(docker ps -aq)
 
   # run the new container, has auto restart enabled so functionality is not interrupted
   echo "Running the new Docker container..."
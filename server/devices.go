@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// device resolution presets and the grid planner that fits a wallpaper to them
+// each preset has the screen's pixel resolution and safe-area insets, the parts a wallpaper shouldn't put artwork under:
+// notches and lock screen clocks on phones, the bottom controls and home indicator, taskbars, docks and menu bars
+// the insets are generous approximations of the stock lock screen or desktop, not exact system values
+// multi-monitor spans are made of equal screens side by side, each one is planned on its own so no tile straddles a bezel
+
+const (
+	minPlannedTile = 64 // smaller than this and the art stops being recognizable on a real screen
+)
+
+var errDeviceNotFound = errors.New("device preset not found")
+
+type safeArea struct {
+	Top    int `json:"top"`
+	Right  int `json:"right"`
+	Bottom int `json:"bottom"`
+	Left   int `json:"left"`
+}
+
+type devicePreset struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Category    string   `json:"category"` // phone, tablet, monitor or multi-monitor
+	Width       int      `json:"width"`
+	Height      int      `json:"height"`
+	AspectRatio string   `json:"aspectRatio"`
+	Screens     int      `json:"screens"`  // side by side screens the resolution spans, 1 for everything but multi-monitor
+	SafeArea    safeArea `json:"safeArea"` // per screen for spans
+}
+
+var devicePresets = []devicePreset{
+	{"iphone-se", "iPhone SE", "phone", 750, 1334, "16:9", 1, safeArea{Top: 470, Bottom: 120}},
+	{"iphone-15", "iPhone 15", "phone", 1179, 2556, "19.5:9", 1, safeArea{Top: 720, Bottom: 300}},
+	{"iphone-15-pro-max", "iPhone 15 Pro Max", "phone", 1290, 2796, "19.5:9", 1, safeArea{Top: 790, Bottom: 320}},
+	{"pixel-8", "Pixel 8", "phone", 1080, 2400, "20:9", 1, safeArea{Top: 560, Bottom: 220}},
+	{"galaxy-s24", "Galaxy S24", "phone", 1080, 2340, "19.5:9", 1, safeArea{Top: 540, Bottom: 220}},
+	{"ipad-10", "iPad (10th gen)", "tablet", 1640, 2360, "10:7", 1, safeArea{Top: 420, Bottom: 60}},
+	{"ipad-pro-13", "iPad Pro 13\"", "tablet", 2064, 2752, "4:3", 1, safeArea{Top: 440, Bottom: 60}},
+	{"galaxy-tab-s9", "Galaxy Tab S9", "tablet", 1600, 2560, "16:10", 1, safeArea{Top: 300, Bottom: 100}},
+	{"macbook-air-13", "MacBook Air 13\"", "monitor", 2560, 1664, "16:10", 1, safeArea{Top: 74, Bottom: 140}},
+	{"1080p", "1080p monitor", "monitor", 1920, 1080, "16:9", 1, safeArea{Bottom: 48}},
+	{"1440p", "1440p monitor", "monitor", 2560, 1440, "16:9", 1, safeArea{Bottom: 64}},
+	{"4k", "4K monitor", "monitor", 3840, 2160, "16:9", 1, safeArea{Bottom: 96}},
+	{"ultrawide-1440p", "Ultrawide 1440p monitor", "monitor", 3440, 1440, "21:9", 1, safeArea{Bottom: 64}},
+	{"ultrawide-2160p", "Ultrawide 5K2K monitor", "monitor", 5120, 2160, "21:9", 1, safeArea{Bottom: 96}},
+	{"dual-1080p", "Two 1080p monitors", "multi-monitor", 3840, 1080, "32:9", 2, safeArea{Bottom: 48}},
+	{"dual-1440p", "Two 1440p monitors", "multi-monitor", 5120, 1440, "32:9", 2, safeArea{Bottom: 64}},
+	{"triple-1080p", "Three 1080p monitors", "multi-monitor", 5760, 1080, "48:9", 3, safeArea{Bottom: 48}},
+}
+
+func findDevice(id string) (*devicePreset, error) {
+	for i := range devicePresets {
+		if devicePresets[i].ID == id {
+			return &devicePresets[i], nil
+		}
+	}
+	return nil, errDeviceNotFound
+}
+
+// the usable part of each screen, in wallpaper coordinates
+func (d *devicePreset) safeRects() []image.Rectangle {
+	screenWidth := d.Width / d.Screens
+	rects := make([]image.Rectangle, d.Screens)
+	for i := range rects {
+		x := i * screenWidth
+		rects[i] = image.Rect(x+d.SafeArea.Left, d.SafeArea.Top, x+screenWidth-d.SafeArea.Right, d.Height-d.SafeArea.Bottom)
+	}
+	return rects
+}
+
+// a planned grid, the same on every screen of a span
+type gridPlan struct {
+	Device   string            `json:"device"`
+	Columns  int               `json:"columns"` // across the whole wallpaper, so per screen times screens
+	Rows     int               `json:"rows"`
+	Tiles    int               `json:"tiles"`
+	TileSize int               `json:"tileSize"`
+	GapX     int               `json:"gapX"` // gaps are stretched so the grid fills the safe area edge to edge
+	GapY     int               `json:"gapY"`
+	Cells    []gridCell        `json:"cells"` // top left corner of each tile, row by row, screen by screen
+	Areas    []image.Rectangle `json:"-"`
+	Rects    []image.Rectangle `json:"-"`
+}
+
+type gridCell struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// pick the columns, rows and tile size that cover as much of the safe areas as possible with whole tiles, at least a
+// tenth of a tile apart and from the edges
+// the grid can come out up to a quarter short of the tiles wanted when that fits the screen's shape much better, i.e. 8
+// tiles in 4x2 rather than 3x3 on a landscape monitor, but never goes over (past every screen of a span getting one)
+func planGrid(d *devicePreset, want int) (*gridPlan, error) {
+	areas := d.safeRects()
+	area := areas[0]
+	perScreen := max(1, want/d.Screens)
+	enough := max(1, perScreen-perScreen/4)
+	if area.Dx() < minPlannedTile || area.Dy() < minPlannedTile {
+		return nil, fmt.Errorf("device %s has no room for tiles", d.ID)
+	}
+
+	var best *gridPlan
+	bestEnough, bestCover := false, 0
+	for cols := 1; cols <= perScreen; cols++ {
+		for rows := 1; cols*rows <= perScreen; rows++ {
+			// a tile plus its share of the gaps is 1.1 tiles, with one extra gap at the far edge
+			tile := min(area.Dx()*10/(cols*11+1), area.Dy()*10/(rows*11+1))
+			if tile < minPlannedTile {
+				break // more rows only make the tiles smaller
+			}
+			count := cols * rows
+			isEnough, cover := count >= enough, count*tile*tile
+			if best != nil {
+				if bestEnough && !isEnough {
+					continue
+				}
+				if bestEnough == isEnough && (cover < bestCover || (cover == bestCover && count*d.Screens <= best.Tiles)) {
+					continue
+				}
+			}
+			bestEnough, bestCover = isEnough, cover
+			best = &gridPlan{
+				Device:   d.ID,
+				Columns:  cols * d.Screens,
+				Rows:     rows,
+				Tiles:    count * d.Screens,
+				TileSize: tile,
+				GapX:     (area.Dx() - cols*tile) / (cols + 1),
+				GapY:     (area.Dy() - rows*tile) / (rows + 1),
+			}
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("device %s has no room for tiles of at least %dpx", d.ID, minPlannedTile)
+	}
+
+	best.Areas = areas
+	perCols := best.Columns / d.Screens
+	for _, a := range areas {
+		// whatever the integer gaps leave over goes around the outside so the grid stays centered
+		offX := (a.Dx() - perCols*best.TileSize - (perCols+1)*best.GapX) / 2
+		offY := (a.Dy() - best.Rows*best.TileSize - (best.Rows+1)*best.GapY) / 2
+		for row := 0; row < best.Rows; row++ {
+			for col := 0; col < perCols; col++ {
+				x := a.Min.X + offX + best.GapX + col*(best.TileSize+best.GapX)
+				y := a.Min.Y + offY + best.GapY + row*(best.TileSize+best.GapY)
+				best.Cells = append(best.Cells, gridCell{x, y})
+				best.Rects = append(best.Rects, image.Rect(x, y, x+best.TileSize, y+best.TileSize))
+			}
+		}
+	}
+	return best, nil
+}
+
+// lay out a wallpaper for a device, the whole screen gets the background and the planned grid holds the art
+// grids are filled screen by screen so a span reads left to right across the monitors, and the profile picture goes in
+// the middle of the first screen's safe area
+func deviceWallpaper(settings *Preferences, d *devicePreset, urls []string, profileURL string) (*wallpaper, error) {
+	plan, err := planGrid(d, settings.GridSize.X*settings.GridSize.Y)
+	if err != nil {
+		return nil, err
+	}
+	wp := &wallpaper{
+		Width:       d.Width,
+		Height:      d.Height,
+		UseGradient: settings.UseGradient,
+		Color1:      settings.Color1,
+		Color2:      settings.Color2,
+		TileRadius:  plan.TileSize * 8 / 100,
+	}
+	// plan.Rects run screen by screen, so a cell's rect is found by its screen first, a bigger mosaic tile stretches from
+	// its top left cell to its bottom right one
+	perCols := plan.Columns / d.Screens
+	cell := func(x, y int) image.Rectangle {
+		return plan.Rects[x/perCols*perCols*plan.Rows+y*perCols+x%perCols]
+	}
+	for _, mt := range layoutTiles(settings, plan.Columns, plan.Rows, d.Screens) {
+		t := renderTile{Rect: cell(mt.X, mt.Y).Union(cell(mt.X+mt.Size-1, mt.Y+mt.Size-1))}
+		if mt.Rank <= len(urls) {
+			t.ImageURL = urls[mt.Rank-1]
+		}
+		wp.Tiles = append(wp.Tiles, t)
+	}
+	if settings.IncludeProfilePicture && profileURL != "" {
+		a := plan.Areas[0]
+		size := min(plan.TileSize*175/100, a.Dx(), a.Dy())
+		x, y := a.Min.X+(a.Dx()-size)/2, a.Min.Y+(a.Dy()-size)/2
+		wp.Profile = &renderTile{Rect: image.Rect(x, y, x+size, y+size), ImageURL: profileURL}
+		wp.ProfileRing = max(1, size*13/175)
+	}
+	return wp, nil
+}
+
+// the wallpaper layout for a device if one was asked for, otherwise the plain grid
+func layoutWallpaper(settings *Preferences, device string, urls []string, profileURL string) (*wallpaper, error) {
+	if device == "" {
+		return gridWallpaper(settings, urls, profileURL), nil
+	}
+	d, err := findDevice(device)
+	if err != nil {
+		return nil, err
+	}
+	return deviceWallpaper(settings, d, urls, profileURL)
+}
+
+// the device catalog, it only changes with a deploy so clients can hold on to it
+func handleListDevices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	writeJSON(w, http.StatusOK, devicePresets)
+}
+
+// the grid the planner picks for a device, ?tiles= is how many tiles are wanted, 99 if it's not given
+func handlePlanDevice(w http.ResponseWriter, r *http.Request) {
+	d, err := findDevice(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "not_found", "No such device preset")
+		return
+	}
+	want := maxTopContent
+	if v := r.URL.Query().Get("tiles"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTopContent {
+			writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("tiles must be between 1 and %d", maxTopContent))
+			return
+		}
+		want = n
+	}
+	plan, err := planGrid(d, want)
+	if err != nil {
+		log.Printf("Error planning grid for %s: %v", d.ID, err)
+		writeError(w, http.StatusUnprocessableEntity, "no_layout", err.Error())
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	writeJSON(w, http.StatusOK, plan)
+}
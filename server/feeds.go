@@ -0,0 +1,686 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// auto-updating wallpaper feeds, a secret per-device url like /feed/{feedToken}.png?preset=phone that always renders the
+// user's current top items, for phone automations and desktop scripts to pull on a schedule
+// a feed made for a device preset renders at that device's resolution around its safe areas, ?device= picks another
+// each feed gets its own copy of the Spotify session it was created from, so it keeps working after the user logs out of
+// the browser and refreshes its access token the same way any other session does
+// the feed token is the feed's ID and a secret, only a hash of the secret is stored so the table alone can't be used to
+// pull anyone's wallpaper
+
+const maxFeedsPerUser = 10
+
+// how stale a feed's last pull time can get before an unchanged pull writes it again, automations can pull every few
+// minutes and most of those are 304s, so recording each one would be a table write per poll
+const feedTouchInterval = 15 * time.Minute
+
+var errFeedNotFound = errors.New("feed not found")
+
+// how long a feed reuses the top items it fetched, wallpapers only need to follow listening habits day to day
+var feedContentTTL = time.Hour
+
+// rendered feed PNGs keyed by their ETag, which covers everything drawn
+var feedRenders = newRenderCache(32)
+
+type Feed struct {
+	ID            string     `json:"id"`
+	OwnerID       string     `json:"-"`
+	Name          string     `json:"name"`
+	Device        string     `json:"device,omitempty"` // device preset the feed renders for unless ?device= says otherwise
+	SecretHash    string     `json:"-"`
+	TokenKey      string     `json:"-"` // the feed's own session
+	CreatedAt     time.Time  `json:"createdAt"`
+	LastFetchedAt *time.Time `json:"lastFetchedAt,omitempty"` // to within feedTouchInterval
+	LastModified  *time.Time `json:"lastModified,omitempty"`  // when the rendered wallpaper last changed
+	LastETag      string     `json:"-"`
+}
+
+type feedStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+var feeds *feedStore
+
+func (s *feedStore) Put(ctx context.Context, feed *Feed) error {
+	item := map[string]types.AttributeValue{
+		"FeedID":     &types.AttributeValueMemberS{Value: feed.ID},
+		"OwnerID":    &types.AttributeValueMemberS{Value: feed.OwnerID},
+		"Name":       &types.AttributeValueMemberS{Value: feed.Name},
+		"SecretHash": &types.AttributeValueMemberS{Value: feed.SecretHash},
+		"TokenKey":   &types.AttributeValueMemberS{Value: feed.TokenKey},
+		"CreatedAt":  &types.AttributeValueMemberN{Value: strconv.FormatInt(feed.CreatedAt.Unix(), 10)},
+	}
+	if feed.Device != "" {
+		item["Device"] = &types.AttributeValueMemberS{Value: feed.Device}
+	}
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(FeedID)"),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating feed: %w", err)
+	}
+	return nil
+}
+
+// a single feed, errFeedNotFound if there's no such ID
+func (s *feedStore) Get(ctx context.Context, id string) (*Feed, error) {
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"FeedID": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching feed: %w", err)
+	}
+	if result.Item == nil {
+		return nil, errFeedNotFound
+	}
+	return feedFromItem(result.Item), nil
+}
+
+// swap in a new secret, the old feed url stops working straight away
+func (s *feedStore) Rotate(ctx context.Context, id, secretHash string) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"FeedID": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET SecretHash = :hash"),
+		ConditionExpression: aws.String("attribute_exists(FeedID)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":hash": &types.AttributeValueMemberS{Value: secretHash},
+		},
+	})
+	var missing *types.ConditionalCheckFailedException
+	if errors.As(err, &missing) {
+		return errFeedNotFound
+	}
+	return err
+}
+
+// note a pull, and when the wallpaper changed if it did
+func (s *feedStore) Touch(ctx context.Context, feed *Feed) error {
+	values := map[string]types.AttributeValue{
+		":fetched": &types.AttributeValueMemberN{Value: strconv.FormatInt(feed.LastFetchedAt.Unix(), 10)},
+	}
+	update := "SET LastFetchedAt = :fetched"
+	if feed.LastModified != nil {
+		update += ", LastModified = :modified, LastETag = :etag"
+		values[":modified"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(feed.LastModified.Unix(), 10)}
+		values[":etag"] = &types.AttributeValueMemberS{Value: feed.LastETag}
+	}
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"FeedID": &types.AttributeValueMemberS{Value: feed.ID},
+		},
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("attribute_exists(FeedID)"),
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+// remove a feed along with its session, returns false if there wasn't one
+func (s *feedStore) Delete(ctx context.Context, feed *Feed) (bool, error) {
+	result, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"FeedID": &types.AttributeValueMemberS{Value: feed.ID},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return false, fmt.Errorf("error deleting feed: %w", err)
+	}
+	if err := tokens.Delete(ctx, feed.TokenKey); err != nil {
+		return false, fmt.Errorf("error deleting feed session: %w", err)
+	}
+	feedContent.forget(feed.TokenKey)
+	return result.Attributes != nil, nil
+}
+
+// every feed, oldest first, the table stays small enough that a scan is fine
+func (s *feedStore) List(ctx context.Context) ([]*Feed, error) {
+	list := []*Feed{}
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{TableName: aws.String(s.table)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning feeds: %w", err)
+		}
+		for _, item := range page.Items {
+			list = append(list, feedFromItem(item))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+// a user's feeds, oldest first
+func (s *feedStore) ListOwnedBy(ctx context.Context, userID string) ([]*Feed, error) {
+	list, err := s.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	owned := []*Feed{}
+	for _, feed := range list {
+		if feed.OwnerID == userID {
+			owned = append(owned, feed)
+		}
+	}
+	return owned, nil
+}
+
+func feedFromItem(item map[string]types.AttributeValue) *Feed {
+	feed := &Feed{}
+	if v, ok := item["FeedID"].(*types.AttributeValueMemberS); ok {
+		feed.ID = v.Value
+	}
+	if v, ok := item["OwnerID"].(*types.AttributeValueMemberS); ok {
+		feed.OwnerID = v.Value
+	}
+	if v, ok := item["Name"].(*types.AttributeValueMemberS); ok {
+		feed.Name = v.Value
+	}
+	if v, ok := item["Device"].(*types.AttributeValueMemberS); ok {
+		feed.Device = v.Value
+	}
+	if v, ok := item["SecretHash"].(*types.AttributeValueMemberS); ok {
+		feed.SecretHash = v.Value
+	}
+	if v, ok := item["TokenKey"].(*types.AttributeValueMemberS); ok {
+		feed.TokenKey = v.Value
+	}
+	if v, ok := item["LastETag"].(*types.AttributeValueMemberS); ok {
+		feed.LastETag = v.Value
+	}
+	if v, ok := item["CreatedAt"].(*types.AttributeValueMemberN); ok {
+		seconds, _ := strconv.ParseInt(v.Value, 10, 64)
+		feed.CreatedAt = time.Unix(seconds, 0).UTC()
+	}
+	if v, ok := item["LastFetchedAt"].(*types.AttributeValueMemberN); ok {
+		seconds, _ := strconv.ParseInt(v.Value, 10, 64)
+		fetched := time.Unix(seconds, 0).UTC()
+		feed.LastFetchedAt = &fetched
+	}
+	if v, ok := item["LastModified"].(*types.AttributeValueMemberN); ok {
+		seconds, _ := strconv.ParseInt(v.Value, 10, 64)
+		modified := time.Unix(seconds, 0).UTC()
+		feed.LastModified = &modified
+	}
+	return feed
+}
+
+// a fresh secret and the hash that gets stored for it
+func newFeedSecret() (string, string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("error generating feed secret: %w", err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	return secret, hashFeedSecret(secret), nil
+}
+
+func hashFeedSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// the url handed to the user, the only time the secret is ever sent out
+func feedURL(id, secret string) string {
+	return publicURL + "/feed/" + id + "." + secret + ".png"
+}
+
+// top items and the profile picture reused between pulls, keyed by the feed's session
+type feedContentCache struct {
+	mu      sync.Mutex
+	entries map[string]feedContentEntry
+}
+
+type feedContentEntry struct {
+	items   []contentItem
+	profile string
+	expires time.Time
+}
+
+var feedContent = &feedContentCache{entries: map[string]feedContentEntry{}}
+
+func (c *feedContentCache) get(key string) (feedContentEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return feedContentEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *feedContentCache) put(key string, entry feedContentEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	entry.expires = now.Add(feedContentTTL)
+	c.entries[key] = entry
+}
+
+// drop everything cached for a session
+func (c *feedContentCache) forget(tokenKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.entries {
+		if strings.HasPrefix(k, tokenKey+"|") {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// the feed's top items for the layout, from the cache when it's fresh enough
+func feedTopContent(ctx context.Context, feed *Feed, settings *Preferences) (feedContentEntry, error) {
+	key := feed.TokenKey + "|" + settings.SelectionType
+	if settings.IncludeProfilePicture {
+		key += "|profile"
+	}
+	if entry, ok := feedContent.get(key); ok {
+		return entry, nil
+	}
+
+	token, err := tokens.Fetch(ctx, feed.TokenKey)
+	if err != nil {
+		return feedContentEntry{}, err
+	}
+	// always the full 99 so every layout of the same type can share the one entry
+	raw, _, err := getTopContent(ctx, token.AccessToken, token.TokenID, settings.SelectionType, maxTopContent, 0)
+	if err != nil {
+		return feedContentEntry{}, err
+	}
+	entry := feedContentEntry{items: compactContent(raw, 0, renderTilePx)}
+	if settings.IncludeProfilePicture {
+		picture, err := fetchProfilePicture(ctx, token, renderTilePx*2)
+		if err != nil {
+			return feedContentEntry{}, err
+		}
+		if picture != nil {
+			entry.profile = picture.URL
+		}
+	}
+	feedContent.put(key, entry)
+	return entry, nil
+}
+
+// the layout for a pull, ?preset= names one of the user's presets (or gives its ID), otherwise their saved preferences
+func feedSettings(ctx context.Context, feed *Feed, preset string) (*Preferences, error) {
+	if preset == "" {
+		prefs, err := users.GetPreferences(ctx, feed.OwnerID)
+		if err != nil && !errors.Is(err, errUserNotFound) {
+			return nil, err
+		}
+		if prefs == nil {
+			prefs = defaultPreferences()
+		}
+		prefs.UpdatedAt = nil
+		return prefs, nil
+	}
+	owned, err := presetsOwnedBy(ctx, feed.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range owned {
+		if p.ID == preset || strings.EqualFold(p.Name, preset) {
+			return &p.Settings, nil
+		}
+	}
+	return nil, errPresetNotFound
+}
+
+// the feed itself, public since the secret in the url is the credential
+func handleFeed(w http.ResponseWriter, r *http.Request) {
+	// never let a shared cache hold on to someone's feed, and send no referrer that could leak the url
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	name, ok := strings.CutSuffix(r.PathValue("file"), ".png")
+	id, secret, found := strings.Cut(name, ".")
+	if !ok || !found {
+		writeError(w, http.StatusNotFound, "not_found", "No such feed")
+		return
+	}
+	feed, err := feeds.Get(r.Context(), id)
+	if err == nil && subtle.ConstantTimeCompare([]byte(hashFeedSecret(secret)), []byte(feed.SecretHash)) != 1 {
+		err = errFeedNotFound
+	}
+	if errors.Is(err, errFeedNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "No such feed")
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching feed %s: %v", id, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching feed")
+		return
+	}
+
+	settings, err := feedSettings(r.Context(), feed, r.URL.Query().Get("preset"))
+	if errors.Is(err, errPresetNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "No such preset")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading settings for feed %s: %v", feed.ID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching feed")
+		return
+	}
+
+	content, err := feedTopContent(r.Context(), feed, settings)
+	if errors.Is(err, errTokenNotFound) {
+		writeError(w, http.StatusGone, "feed_expired", "This feed's Spotify session is gone, create a new feed in Wallify")
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching top %s for feed %s: %v", settings.SelectionType, feed.ID, err)
+		writeSpotifyError(w, err, fmt.Sprintf("Error fetching top %s", settings.SelectionType))
+		return
+	}
+
+	device := r.URL.Query().Get("device")
+	if device == "" {
+		device = feed.Device
+	}
+	urls := wallpaperURLs(content.items, settings)
+	order, settings := paletteLayout(r.Context(), urls, settings)
+	ordered := make([]string, len(urls))
+	for n, i := range order {
+		ordered[n] = urls[i]
+	}
+	wp, err := layoutWallpaper(settings, device, ordered, content.profile)
+	if errors.Is(err, errDeviceNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "No such device preset")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "no_layout", err.Error())
+		return
+	}
+	sum, _ := json.Marshal(wp)
+	digest := sha256.Sum256(sum)
+	etag := `"` + hex.EncodeToString(digest[:16]) + `"`
+
+	// only written when the wallpaper changed or the last pull time is more than feedTouchInterval out of date
+	now := time.Now().UTC().Truncate(time.Second)
+	modified := feed.LastModified
+	changed := etag != feed.LastETag || modified == nil
+	if changed || feed.LastFetchedAt == nil || now.Sub(*feed.LastFetchedAt) >= feedTouchInterval {
+		feed.LastFetchedAt = &now
+		if changed {
+			feed.LastETag, feed.LastModified, modified = etag, &now, &now
+		} else {
+			feed.LastModified = nil // unchanged, Touch only records the pull
+		}
+		if err := feeds.Touch(r.Context(), feed); err != nil {
+			log.Printf("Error recording pull of feed %s: %v", feed.ID, err)
+		}
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	if notModified(r, etag, *modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data, ok := feedRenders.Get(etag)
+	if !ok {
+		img, err := renderWallpaper(r.Context(), wp)
+		if err == nil {
+			data, err = encodePNG(img)
+		}
+		if err != nil {
+			log.Printf("Error rendering feed %s: %v", feed.ID, err)
+			w.Header().Del("ETag")
+			w.Header().Del("Last-Modified")
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error rendering wallpaper")
+			return
+		}
+		feedRenders.Add(etag, data)
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// conditional request check, If-None-Match wins over If-Modified-Since when both are sent
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			if c := strings.TrimSpace(candidate); c == etag || c == "*" || c == "W/"+etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		return !modified.After(ims)
+	}
+	return false
+}
+
+// the art urls in grid order, skipping art-less items if the layout says to
+func wallpaperURLs(items []contentItem, settings *Preferences) []string {
+	fit := settings.GridSize.X * settings.GridSize.Y
+	urls := []string{}
+	for _, item := range items {
+		if len(urls) == fit {
+			break
+		}
+		switch {
+		case item.Image != nil:
+			urls = append(urls, item.Image.URL)
+		case !settings.ExcludeNullImages:
+			urls = append(urls, "")
+		}
+	}
+	return urls
+}
+
+// a feed as its owner sees it, the url only comes back when it's created or rotated
+type feedResponse struct {
+	*Feed
+	URL string `json:"url,omitempty"`
+}
+
+// the caller's feeds
+func handleListFeeds(w http.ResponseWriter, r *http.Request) {
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+	owned, err := feeds.ListOwnedBy(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing feeds for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching feeds")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, owned)
+}
+
+// set up a feed for a device, {"name": "phone", "device": "pixel-8"}, the device is optional, the response has the feed url which isn't shown again
+func handleCreateFeed(w http.ResponseWriter, r *http.Request) {
+	token := tokenFromContext(r.Context())
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name   string `json:"name"`
+		Device string `json:"device"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Request body must be a JSON object with a name")
+		return
+	}
+	name, err := presetName(req.Name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_feed", err.Error())
+		return
+	}
+	if req.Device != "" {
+		if _, err := findDevice(req.Device); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_feed", "device must be one of the ids from /api/v1/presets/devices")
+			return
+		}
+	}
+
+	owned, err := feeds.ListOwnedBy(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing feeds for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error creating feed")
+		return
+	}
+	if len(owned) >= maxFeedsPerUser {
+		writeError(w, http.StatusConflict, "feed_limit", fmt.Sprintf("You can have at most %d feeds, revoke one first", maxFeedsPerUser))
+		return
+	}
+
+	id, err := newShortID()
+	if err != nil {
+		log.Printf("Error creating feed: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error creating feed")
+		return
+	}
+	secret, secretHash, err := newFeedSecret()
+	if err != nil {
+		log.Printf("Error creating feed: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error creating feed")
+		return
+	}
+
+	// the feed's own session, a copy of the caller's so logging out elsewhere doesn't stop the feed
+	tokenKey, err := generateUniqueKey(r.Context())
+	if err == nil {
+		err = tokens.Put(r.Context(), &Token{
+			TokenID:      tokenKey,
+			UserID:       userID,
+			AccessToken:  token.AccessToken,
+			RefreshToken: token.RefreshToken,
+			Expiration:   token.Expiration,
+		})
+	}
+	if err != nil {
+		log.Printf("Error creating session for feed: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error creating feed")
+		return
+	}
+
+	feed := &Feed{
+		ID:         id,
+		OwnerID:    userID,
+		Name:       name,
+		Device:     req.Device,
+		SecretHash: secretHash,
+		TokenKey:   tokenKey,
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+	if err := feeds.Put(r.Context(), feed); err != nil {
+		log.Printf("Error creating feed for %s: %v", userID, err)
+		tokens.Delete(r.Context(), tokenKey)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error creating feed")
+		return
+	}
+	writeJSON(w, http.StatusCreated, feedResponse{Feed: feed, URL: feedURL(feed.ID, secret)})
+}
+
+// replace a feed's secret, for when the url has leaked, the response has the new url
+func handleRotateFeed(w http.ResponseWriter, r *http.Request) {
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+	feed, ok := ownedFeed(w, r, userID)
+	if !ok {
+		return
+	}
+	secret, secretHash, err := newFeedSecret()
+	if err == nil {
+		err = feeds.Rotate(r.Context(), feed.ID, secretHash)
+	}
+	if errors.Is(err, errFeedNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "No such feed")
+		return
+	}
+	if err != nil {
+		log.Printf("Error rotating feed %s: %v", feed.ID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error rotating feed")
+		return
+	}
+	writeJSON(w, http.StatusOK, feedResponse{Feed: feed, URL: feedURL(feed.ID, secret)})
+}
+
+// revoke a feed, its url and its session stop working straight away
+func handleRevokeFeed(w http.ResponseWriter, r *http.Request) {
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+	feed, ok := ownedFeed(w, r, userID)
+	if !ok {
+		return
+	}
+	if _, err := feeds.Delete(r.Context(), feed); err != nil {
+		log.Printf("Error revoking feed %s: %v", feed.ID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error revoking feed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func ownedFeed(w http.ResponseWriter, r *http.Request, userID string) (*Feed, bool) {
+	feed, err := feeds.Get(r.Context(), r.PathValue("id"))
+	if err == nil && feed.OwnerID != userID {
+		err = errFeedNotFound
+	}
+	if errors.Is(err, errFeedNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "No such feed")
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error fetching feed: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching feed")
+		return nil, false
+	}
+	return feed, true
+}
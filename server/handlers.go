@@ -3,24 +3,47 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
-func enableCors(w *http.ResponseWriter) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-	(*w).Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	(*w).Header().Set("Access-Control-Allow-Headers", "Content-Type, x-token-key")
-	(*w).Header().Set("Access-Control-Max-Age", "86400")
+// shared client for all outbound Spotify calls, reusing connections across requests instead of dialing fresh for each one
+// the overall timeout is a backstop, the request context is what normally cancels a call when the browser goes away
+var spotifyClient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: spotifyMetricsTransport{next: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}},
+}
+
+// login route, basically uses the Spotify API to generate an auth URL and redirects the user to the Spotify login page
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	authUrl := fmt.Sprintf(
+		"https://accounts.spotify.com/authorize?client_id=%s&response_type=code&redirect_uri=%s&scope=user-top-read user-read-email user-read-private",
+		clientId, url.QueryEscape(redirectUri))
+
+	log.Println("Generated Authorization URL:", authUrl)
+	http.Redirect(w, r, authUrl, http.StatusSeeOther)
 }
 
 // route to handle the callback from Spotify after the user is authenticated
@@ -28,11 +51,11 @@ func handleCallback(w http.ResponseWriter, r *http.Request) {
 	code := r.URL.Query().Get("code")
 	if code == "" {
 		log.Println("Authorization code is missing")
-		http.Error(w, "Authorization code is missing", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "missing_code", "Authorization code is missing")
 		return
 	}
 
-	log.Println("Authorization code:", code)
+	log.Println("Authorization code:", maskToken(code))
 
 	// create the form data to send in the token request
 	data := url.Values{}
@@ -41,117 +64,231 @@ func handleCallback(w http.ResponseWriter, r *http.Request) {
 	data.Set("redirect_uri", redirectUri)
 
 	// make a post request to spotify's access token endpoint
-	req, err := http.NewRequest("POST", "https://accounts.spotify.com/api/token", strings.NewReader(data.Encode()))
-	if err != nil { // i.e. if there is an error, log it and exit
-		log.Fatalf("Error creating request: %v", err)
+	req, err := http.NewRequestWithContext(r.Context(), "POST", "https://accounts.spotify.com/api/token", strings.NewReader(data.Encode()))
+	if err != nil { // i.e. if there is an error, log it and bail out of the request
+		log.Printf("Error creating request: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error creating token request")
+		return
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.SetBasicAuth(clientId, clientSecret)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil { // i.e. if there is an error, log it and exit
-		log.Fatalf("Error sending token request: %v", err)
+	resp, err := spotifyClient.Do(req)
+	if err != nil { // i.e. if there is an error, log it and bail out of the request
+		log.Printf("Error sending token request: %v", err)
+		writeError(w, http.StatusBadGateway, "spotify_error", "Error requesting tokens from Spotify")
+		return
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatalf("Error reading response body: %v", err)
+		log.Printf("Error reading response body: %v", err)
+		writeError(w, http.StatusBadGateway, "spotify_error", "Error reading token response from Spotify")
+		return
 	}
 
-	log.Println("Response from Spotify:", string(body))
-
 	// parse the JSON response to extract the access token
 	var tokenResponse map[string]interface{}
 	if err := json.Unmarshal(body, &tokenResponse); err != nil {
-		log.Fatalf("Error unmarshalling token response: %v", err)
+		log.Printf("Error unmarshalling token response: %v", err)
+		writeError(w, http.StatusBadGateway, "spotify_error", "Error parsing token response from Spotify")
+		return
 	}
+	log.Printf("Token response from Spotify: status %d, fields: %v", resp.StatusCode, responseFields(tokenResponse))
 
 	accessToken, ok := tokenResponse["access_token"].(string)
 	if !ok {
-		log.Fatalf("Access token missing from response: %v", tokenResponse)
+		log.Printf("Access token missing from response, fields: %v", responseFields(tokenResponse))
+		writeError(w, http.StatusBadGateway, "spotify_error", "Access token missing from Spotify response")
+		return
 	}
 
 	refreshToken, ok := tokenResponse["refresh_token"].(string)
 	if !ok {
-		log.Fatalf("Refresh token token missing from response: %v", tokenResponse)
+		log.Printf("Refresh token missing from response, fields: %v", responseFields(tokenResponse))
+		writeError(w, http.StatusBadGateway, "spotify_error", "Refresh token missing from Spotify response")
+		return
 	}
 
 	// generate a unique key for the token
-	key, err := generateUniqueKey()
+	key, err := generateUniqueKey(r.Context())
 	if err != nil {
-		log.Fatalf("Error generating unique key: %v", err)
+		log.Printf("Error generating unique key: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error creating session")
+		return
 	}
 
-	// create dynamo item
-	item := map[string]types.AttributeValue{
-		"TokenID":      &types.AttributeValueMemberS{Value: key},
-		"AccessToken":  &types.AttributeValueMemberS{Value: accessToken},
-		"RefreshToken": &types.AttributeValueMemberS{Value: refreshToken},
-		"Expiration":   &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", time.Now().Unix())},
+	// process the user for metrics purposes, and so the session knows whose it is
+	profile, err := processUser(r.Context(), accessToken)
+	if errors.Is(err, errNotAllowlisted) {
+		// Spotify logged them in but won't serve their data, so there's no point in a session, send them to ask for access instead
+		log.Printf("User is not on the Development Mode allowlist: %v", err)
+		userLogins.inc("not_allowlisted")
+		http.Redirect(w, r, clientOrigin(r)+"/?error=not_allowlisted", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Printf("Error processing user: %v", err)
+		writeError(w, http.StatusBadGateway, "spotify_error", "Error fetching your Spotify profile")
+		return
 	}
 
-	// store the token in dynamo
-	_, err = dynamoClient.PutItem(context.Background(), &dynamodb.PutItemInput{
-		TableName: aws.String(tableName),
-		Item:      item,
+	// store the token
+	err = tokens.Put(r.Context(), &Token{
+		TokenID:      key,
+		UserID:       profile.ID,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		Expiration:   time.Now().Unix(),
 	})
 	if err != nil {
-		log.Fatalf("Error storing token in DynamoDB table %s: %v", tableName, err)
+		log.Printf("Error storing token in DynamoDB table %s: %v", tableName, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error creating session")
+		return
 	}
 
-	log.Println("Successfully stored tokens in DynamoDB for key:", key)
+	log.Println("Successfully stored tokens in DynamoDB for key:", maskToken(key))
 
-	// process the user for metrics purposes
-	err = processUser(accessToken)
-	if err != nil {
-		log.Fatalf("Error processing user: %v", err)
-	}
+	// redirect the user back to the React app with the token key
+	http.Redirect(w, r, fmt.Sprintf("%s/?token_key=%s", clientOrigin(r), key), http.StatusSeeOther)
+}
 
-	// redirect the user back to the React app with the token key based on the origin (localhost or production)
-	var clientRedirect string
+// pick the React app to send the user back to based on the origin (localhost or production)
+func clientOrigin(r *http.Request) string {
 	if strings.HasPrefix(r.Referer(), "http://localhost:3000") {
-		clientRedirect = fmt.Sprintf("http://localhost:3000/?token_key=%s", key)
-	} else {
-		clientRedirect = fmt.Sprintf("https://wallify.doypid.com/?token_key=%s", key)
+		return "http://localhost:3000"
 	}
+	return "https://wallify.doypid.com"
+}
+
+const (
+	spotifyPageSize = 50 // Spotify caps each top items request at 50 items
+	maxTopContent   = 99 // Spotify stops serving top items past the 99th
+)
 
-	http.Redirect(w, r, clientRedirect, http.StatusSeeOther)
+// paged response for the top artists and tracks routes
+// items are either compact contentItems or the raw Spotify objects depending on the requested view
+type topContentResponse struct {
+	Items      interface{}          `json:"items"`
+	Total      int                  `json:"total"`
+	Offset     int                  `json:"offset"`
+	Limit      int                  `json:"limit"`
+	NextOffset *int                 `json:"next_offset"`
+	HasMore    bool                 `json:"has_more"`
+	Layout     *mosaicLayout        `json:"layout,omitempty"`     // only with ?layout=mosaic
+	Background *suggestedBackground `json:"background,omitempty"` // only with palettes
+}
+
+// read the limit and offset query parameters, defaulting to the full 99 items
+func parsePaging(query url.Values) (int, int, error) {
+	limit, offset := maxTopContent, 0
+
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTopContent {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxTopContent)
+		}
+		limit = n
+	}
+
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n >= maxTopContent {
+			return 0, 0, fmt.Errorf("offset must be between 0 and %d", maxTopContent-1)
+		}
+		offset = n
+	}
+
+	if offset+limit > maxTopContent {
+		return 0, 0, fmt.Errorf("offset + limit must not exceed %d", maxTopContent)
+	}
+	return limit, offset, nil
+}
+
+// route to end the caller's session, the token row is deleted so the key stops working straight away
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	token := tokenFromContext(r.Context())
+	if err := tokens.Delete(r.Context(), token.TokenID); err != nil {
+		log.Printf("Error deleting token: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error ending session")
+		return
+	}
+	activeSessions.forget(token.TokenID)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func handleTopContent(contentType string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		enableCors(&w)
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
+		token := tokenFromContext(r.Context())
+		tokenKey := token.TokenID
+		log.Printf("Request received for top %s with Token Key %v\n", contentType, maskToken(tokenKey))
+
+		limit, offset, err := parsePaging(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
 			return
 		}
 
-		tokenKey := r.Header.Get("x-token-key")
-		log.Printf("Request received for top %s with Token Key %v\n", contentType, tokenKey)
+		view, err := parseView(r.URL.Query().Get("view"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
 
-		token, err := FetchToken(tokenKey)
+		tilePx, err := parseTilePx(r.URL.Query().Get("tile_px"))
 		if err != nil {
-			http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
-			log.Printf("Invalid or missing token")
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
 			return
 		}
 
-		totalContent := 99 // always return 99 items
+		layout, fit, err := parseLayoutQuery(r.URL.Query(), offset)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
 
-		// split the request for the 99 items into multiple requests of max 50 items each
-		topContent, err := getTopContent(token.AccessToken, tokenKey, contentType, totalContent)
+		order, withPalette, err := parsePaletteQuery(r.URL.Query())
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error fetching top %s", contentType), http.StatusInternalServerError)
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		if withPalette && view != viewCompact {
+			writeError(w, http.StatusBadRequest, "invalid_request", "palette and order need the compact view")
+			return
+		}
+
+		// split the request into as few requests of max 50 items each as it takes to cover the window
+		topContent, total, err := getTopContent(r.Context(), token.AccessToken, tokenKey, contentType, limit, offset)
+		if err != nil {
+			writeSpotifyError(w, err, fmt.Sprintf("Error fetching top %s", contentType))
 			log.Printf("Error fetching top %s: %v", contentType, err)
 			return
 		}
 
-		response, err := json.Marshal(topContent)
+		page := topContentResponse{
+			Items:  topContent,
+			Total:  total,
+			Offset: offset,
+			Limit:  limit,
+			Layout: layout,
+		}
+		if next := offset + len(topContent); len(topContent) == limit && next < total {
+			page.NextOffset = &next
+			page.HasMore = true
+		}
+		if view == viewCompact {
+			items := compactContent(topContent, offset, tilePx)
+			if withPalette {
+				items, page.Background = colorContent(r.Context(), items, order, fit, keepRanked(r.URL.Query().Get("layout"), offset+1))
+			}
+			page.Items = items
+		}
+
+		response, err := json.Marshal(page)
 		if err != nil {
-			http.Error(w, "Error marshaling response", http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error marshaling response")
 			log.Printf("Error marshaling response: %v", err)
 			return
 		}
@@ -163,93 +300,141 @@ func handleTopContent(contentType string) http.HandlerFunc {
 
 // route to fetch the user's profile picture
 func handleProfile(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	// get the token key from the request header
-	tokenKey := r.Header.Get("x-token-key")
-	log.Printf("Request received for %v with Token Key %v\n", r.URL.Path, tokenKey)
+	// the session was already looked up from the x-token-key header by requireToken
+	token := tokenFromContext(r.Context())
+	tokenKey := token.TokenID
+	log.Printf("Request received for %v with Token Key %v\n", r.URL.Path, maskToken(tokenKey))
 
-	// fetch the actual token from DynamoDB
-	token, err := FetchToken(tokenKey)
+	tilePx, err := parseTilePx(r.URL.Query().Get("tile_px"))
 	if err != nil {
-		http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
-		log.Printf("Invalid or missing token")
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
 		return
 	}
 
-	// format the request to get the user's profile
-	req, _ := http.NewRequest("GET", "https://api.spotify.com/v1/me", nil)
-	response, err := makeSpotifyRequest(req, token.AccessToken, tokenKey, "profile", 0)
+	profilePicture, err := fetchProfilePicture(r.Context(), token, tilePx)
 	if err != nil {
-		http.Error(w, "Error fetching profile", http.StatusInternalServerError)
+		writeSpotifyError(w, err, "Error fetching profile")
 		return
 	}
+	profilePictureUrl := ""
+	if profilePicture != nil {
+		profilePictureUrl = profilePicture.URL
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"profilePictureUrl": profilePictureUrl,
+		"profilePicture":    profilePicture,
+	})
+}
 
-	// parse the profile picture, some users may not have a profile picture so lots of checks are needed
+// fetch the user's profile picture best fitting tilePx, some users may not have a profile picture so it may be nil
+func fetchProfilePicture(ctx context.Context, token *Token, tilePx int) (*imageEntry, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://api.spotify.com/v1/me", nil)
+	response, err := makeSpotifyRequest(req, token.AccessToken, token.TokenID, "profile", 0)
+	if err != nil {
+		return nil, err
+	}
 	var profileData map[string]interface{}
 	json.Unmarshal(response, &profileData)
-	profilePictureUrl := ""
-	if images, ok := profileData["images"].([]interface{}); ok && len(images) > 0 {
-		if image, ok := images[0].(map[string]interface{}); ok {
-			if url, ok := image["url"].(string); ok {
-				profilePictureUrl = url
+	return pickImage(parseImages(profileData["images"]), tilePx), nil
+}
+
+// helper function to get a window of up to 99 items from the user's top artists or tracks
+// Spotify API limit is 50 items per request, so the window is covered with the fewest 50 item pages starting at the offset
+// the pages are fetched in parallel, the first failure cancels the rest so a dead page doesn't leave the others running
+// the total reported by Spotify is returned alongside the items, capped to what can actually be paged through
+func getTopContent(ctx context.Context, accessToken, tokenKey, content string, limit, offset int) ([]map[string]interface{}, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var offsets []int
+	for pageOffset := offset; pageOffset < offset+limit; pageOffset += spotifyPageSize {
+		offsets = append(offsets, pageOffset)
+	}
+
+	pages := make([][]map[string]interface{}, len(offsets))
+	totals := make([]int, len(offsets))
+	errs := make([]error, len(offsets))
+
+	var wg sync.WaitGroup
+	for i, pageOffset := range offsets {
+		wg.Add(1)
+		go func(i, pageOffset int) {
+			defer wg.Done()
+			pageLimit := min(spotifyPageSize, offset+limit-pageOffset)
+			pages[i], totals[i], errs[i] = getTopContentPage(ctx, accessToken, tokenKey, content, pageLimit, pageOffset)
+			if errs[i] != nil {
+				cancel()
 			}
+		}(i, pageOffset)
+	}
+	wg.Wait()
+
+	// report the error that caused the cancellation rather than the context errors it triggered in the other pages
+	var firstErr error
+	for _, err := range errs {
+		if err == nil {
+			continue
 		}
+		if firstErr == nil || (errors.Is(firstErr, context.Canceled) && !errors.Is(err, context.Canceled)) {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, 0, firstErr
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"profilePictureUrl": profilePictureUrl})
-}
+	results := []map[string]interface{}{}
+	for _, page := range pages {
+		results = append(results, page...)
+	}
 
-// helper function to get the maximum concatenated 99 items from the user's top artists or tracks
-// Spotify API limit is 50 items per request, each client requests 99, this intermediary function is used to handle the requests
-func getTopContent(accessToken, tokenKey, content string, totalContent int) ([]map[string]interface{}, error) {
-	limit := 50
-	var results []map[string]interface{}
+	total := 0
+	for _, t := range totals {
+		total = max(total, t)
+	}
 
-	for offset := 0; offset < totalContent; offset += limit {
-		requestLimit := min(limit, totalContent-offset)
-		url := fmt.Sprintf("https://api.spotify.com/v1/me/top/%s?limit=%d&offset=%d", content, requestLimit, offset)
+	return results[:min(len(results), limit)], min(total, maxTopContent), nil
+}
 
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			return nil, fmt.Errorf("error creating request: %w", err)
-		}
+// fetch a single page of top artists or tracks along with the total Spotify reports for the user
+func getTopContentPage(ctx context.Context, accessToken, tokenKey, content string, limit, offset int) ([]map[string]interface{}, int, error) {
+	url := fmt.Sprintf("https://api.spotify.com/v1/me/top/%s?limit=%d&offset=%d", content, limit, offset)
 
-		resp, err := makeSpotifyRequest(req, accessToken, tokenKey, content, 0)
-		if err != nil {
-			return nil, err
-		}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating request: %w", err)
+	}
 
-		var data map[string]interface{}
-		if err := json.Unmarshal(resp, &data); err != nil {
-			return nil, fmt.Errorf("error unmarshaling response: %w", err)
-		}
+	resp, err := makeSpotifyRequest(req, accessToken, tokenKey, content, 0)
+	if err != nil {
+		return nil, 0, err
+	}
 
-		items, ok := data["items"].([]interface{})
-		if !ok {
-			return nil, fmt.Errorf("unexpected response format")
-		}
+	var data struct {
+		Items []map[string]interface{} `json:"items"`
+		Total int                      `json:"total"`
+	}
+	if err := json.Unmarshal(resp, &data); err != nil {
+		return nil, 0, fmt.Errorf("error unmarshaling response: %w", err)
+	}
 
-		for _, item := range items {
-			results = append(results, item.(map[string]interface{}))
-		}
+	if data.Items == nil {
+		return nil, 0, fmt.Errorf("unexpected response format")
 	}
 
-	return results[:min(len(results), totalContent)], nil
+	return data.Items, data.Total, nil
 }
 
 // helper function to abstract the request process and handle token update/refresh when necessary
+// the request should carry the caller's context so a disconnected client also cancels the refresh and Dynamo calls
 func makeSpotifyRequest(req *http.Request, accessToken, tokenKey, endpoint string, retryCount int) ([]byte, error) {
-	log.Printf("Making request to Spotify API, Endpoint: %s, AccessToken: %s, TokenKey: %s, RetryCount: %d", endpoint, accessToken, tokenKey, retryCount)
-	client := &http.Client{}
+	log.Printf("Making request to Spotify API, Endpoint: %s, TokenKey: %s, RetryCount: %d", endpoint, maskToken(tokenKey), retryCount)
+	ctx := req.Context()
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
 
-	resp, err := client.Do(req)
+	resp, err := spotifyClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error sending request: %w", err)
 	}
@@ -263,27 +448,62 @@ func makeSpotifyRequest(req *http.Request, accessToken, tokenKey, endpoint strin
 	if resp.StatusCode != http.StatusOK {
 		if resp.StatusCode == http.StatusUnauthorized && retryCount < 1 {
 			log.Println("Access token expired, attempting to refresh token...")
-			token, err := FetchToken(tokenKey)
-			if err != nil {
-				return nil, err
-			}
-
-			// get a new access token using the refresh token
-			newAccessToken, err := refreshAccessToken(token.RefreshToken)
+			// shared with any other request on this session that got the same 401, see refreshSession
+			newAccessToken, err := refreshSession(ctx, tokenKey, accessToken)
 			if err != nil {
 				log.Println("Failed to refresh token, returning error.")
-				return nil, fmt.Errorf("error refreshing access token: %w", err)
-			}
-
-			// update access token in dynamo
-			if err := UpdateAccessToken(tokenKey, newAccessToken); err != nil {
-				return nil, fmt.Errorf("error updating access token in DynamoDB: %w", err)
+				return nil, err
 			}
 
 			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", newAccessToken))
 			return makeSpotifyRequest(req, newAccessToken, tokenKey, endpoint, retryCount+1)
 		}
-		return nil, fmt.Errorf("spotify API error: %s", string(body))
+		return nil, parseSpotifyError(resp.StatusCode, body)
 	}
 	return body, nil
 }
+
+// returned when Spotify refuses a user because the app is in Development Mode and they aren't on the dashboard allowlist
+var errNotAllowlisted = errors.New("not_allowlisted")
+
+// any other error response from the Spotify API
+type spotifyAPIError struct {
+	Status  int
+	Message string
+}
+
+func (e *spotifyAPIError) Error() string {
+	return fmt.Sprintf("spotify API error %d: %s", e.Status, e.Message)
+}
+
+// turn a Spotify error response into an error, picking out the Development Mode allowlist rejection
+// Spotify answers those with a 403 whose message points at the developer dashboard, i.e.
+// {"error": {"status": 403, "message": "Check settings on developer.spotify.com/dashboard, the user may not be registered."}}
+func parseSpotifyError(status int, body []byte) error {
+	var data struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	message := string(body)
+	if err := json.Unmarshal(body, &data); err == nil && data.Error.Message != "" {
+		message = data.Error.Message
+	}
+
+	if status == http.StatusForbidden {
+		lower := strings.ToLower(message)
+		if strings.Contains(lower, "not be registered") || strings.Contains(lower, "not registered") || strings.Contains(lower, "developer.spotify.com/dashboard") {
+			return fmt.Errorf("%w: %s", errNotAllowlisted, message)
+		}
+	}
+	return &spotifyAPIError{Status: status, Message: message}
+}
+
+// answer a failed Spotify backed request, users missing from the allowlist get a specific error code the frontend can act on
+func writeSpotifyError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, errNotAllowlisted) {
+		writeError(w, http.StatusForbidden, "not_allowlisted", "This Spotify account hasn't been given access to Wallify yet")
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "spotify_error", message)
+}
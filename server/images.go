@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// only Spotify's image CDN is proxied, anything else would turn /img into an open proxy
+var allowedImageHosts = map[string]bool{
+	"i.scdn.co": true,
+}
+
+const (
+	maxImageBytes    = 10 << 20    // Spotify art tops out well under this
+	maxImagePixels   = 4096 * 4096 // a small file can still decode to something huge, this caps width x height
+	minImageWidth    = 16
+	maxImageWidth    = 2048
+	imageJPEGQuality = 90
+)
+
+// client for image downloads, the same connections as the Spotify calls but every redirect has to pass the same host
+// check as the url it came from, otherwise a redirect off the CDN would turn the proxy into an open one
+var imageClient = &http.Client{
+	Timeout:   spotifyClient.Timeout,
+	Transport: spotifyClient.Transport,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 3 {
+			return errors.New("too many redirects")
+		}
+		return validateImageURL(req.URL.String())
+	},
+}
+
+// shared on-disk image cache, used by the /img proxy and by anything rendering wallpapers server side
+var imgCache *imageCache
+
+// on-disk LRU cache of proxied images, keyed by source url and requested width
+// the index lives in memory and is rebuilt from the directory on startup, oldest files first
+type imageCache struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	size     int64
+	lru      *list.List // front is most recently used
+	entries  map[string]*list.Element
+	inflight map[string]*imageFetch
+}
+
+type imageCacheEntry struct {
+	key  string
+	size int64
+}
+
+// concurrent requests for the same image wait on a single download
+type imageFetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newImageCache(dir string, maxBytes int64) (*imageCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating image cache directory: %w", err)
+	}
+
+	c := &imageCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*imageFetch),
+	}
+
+	// rebuild the index from what's already on disk, least recently used files go to the back
+	type file struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		// leftovers from an interrupted write, or anything else that isn't ours
+		if len(d.Name()) != sha256.Size*2 {
+			os.Remove(path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, file{key: d.Name(), size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading image cache directory: %w", err)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+	for _, f := range files {
+		c.entries[f.key] = c.lru.PushBack(&imageCacheEntry{key: f.key, size: f.size})
+		c.size += f.size
+	}
+	c.evict()
+
+	log.Printf("Image cache ready at %s with %d files (%d bytes)", dir, len(files), c.size)
+	return c, nil
+}
+
+// check that a url points at an allowed image host over https
+func validateImageURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.User != nil || u.Port() != "" {
+		return fmt.Errorf("url must be an https image url")
+	}
+	if !allowedImageHosts[u.Hostname()] {
+		return fmt.Errorf("image host %q is not allowed", u.Hostname())
+	}
+	return nil
+}
+
+// get an image from the cache or the CDN, optionally downscaled to width pixels (0 keeps the original)
+func (c *imageCache) Fetch(ctx context.Context, imageURL string, width int) ([]byte, error) {
+	if err := validateImageURL(imageURL); err != nil {
+		return nil, err
+	}
+
+	key := imageCacheKey(imageURL, width)
+	if data, ok := c.read(key); ok {
+		return data, nil
+	}
+
+	c.mu.Lock()
+	if f, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.data, f.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	f := &imageFetch{done: make(chan struct{})}
+	c.inflight[key] = f
+	c.mu.Unlock()
+
+	// the download is shared so it shouldn't die with whichever caller happened to start it
+	fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 20*time.Second)
+	f.data, f.err = c.download(fetchCtx, imageURL, width)
+	cancel()
+	if f.err == nil {
+		c.write(key, f.data)
+	}
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(f.done)
+
+	return f.data, f.err
+}
+
+// get an image and decode it, for callers that draw it rather than serve it
+func (c *imageCache) FetchImage(ctx context.Context, imageURL string, width int) (image.Image, error) {
+	data, err := c.Fetch(ctx, imageURL, width)
+	if err != nil {
+		return nil, err
+	}
+	return decodeImage(data)
+}
+
+// read just the header and refuse images with more than maxImagePixels before anything decodes the pixels
+func checkImageSize(data []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error decoding image: %w", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > maxImagePixels/cfg.Height {
+		return fmt.Errorf("image is %dx%d, more than %d pixels", cfg.Width, cfg.Height, maxImagePixels)
+	}
+	return nil
+}
+
+// decode an image once its size has been checked
+func decodeImage(data []byte) (image.Image, error) {
+	if err := checkImageSize(data); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+	return img, nil
+}
+
+func (c *imageCache) download(ctx context.Context, imageURL string, width int) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("image CDN returned %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading image: %w", err)
+	}
+	if len(data) > maxImageBytes {
+		return nil, fmt.Errorf("image exceeds %d bytes", maxImageBytes)
+	}
+	if err := checkImageSize(data); err != nil {
+		return nil, err
+	}
+
+	if width == 0 {
+		return data, nil
+	}
+	return resizeImage(data, width)
+}
+
+func (c *imageCache) read(key string) ([]byte, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	path := c.path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		// the file went missing underneath us, drop it from the index and refetch
+		c.mu.Lock()
+		if el, ok := c.entries[key]; ok {
+			c.size -= el.Value.(*imageCacheEntry).size
+			c.lru.Remove(el)
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	// keep the mtime in step with recency so the order survives a restart
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+func (c *imageCache) write(key string, data []byte) {
+	if int64(len(data)) > c.maxBytes {
+		return
+	}
+
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("Error creating image cache directory: %v", err)
+		return
+	}
+
+	// write to a temp file and rename so readers never see a partial image
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		log.Printf("Error writing image cache file: %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Error writing image cache file: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.size -= el.Value.(*imageCacheEntry).size
+		c.lru.Remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&imageCacheEntry{key: key, size: int64(len(data))})
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// drop least recently used files until the cache fits, caller holds the lock
+func (c *imageCache) evict() {
+	for c.size > c.maxBytes {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		entry := el.Value.(*imageCacheEntry)
+		c.lru.Remove(el)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		if err := os.Remove(c.path(entry.key)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error evicting image cache file: %v", err)
+		}
+	}
+}
+
+// files are sharded by the first two characters of the key so no single directory grows too large
+func (c *imageCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+func imageCacheKey(imageURL string, width int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d", imageURL, width)))
+	return hex.EncodeToString(sum[:])
+}
+
+// downscale an encoded image to the given width, keeping the aspect ratio
+// images already at or below the width are passed through untouched rather than upscaled
+func resizeImage(data []byte, width int) ([]byte, error) {
+	src, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	b := src.Bounds()
+	if b.Dx() <= width {
+		return data, nil
+	}
+	height := max(1, b.Dy()*width/b.Dx())
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleImage(src, width, height), &jpeg.Options{Quality: imageJPEGQuality}); err != nil {
+		return nil, fmt.Errorf("error encoding image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// scale an image to exactly w x h by averaging the source pixels that fall under each destination pixel
+// a plain box filter, fine for the downscaling album art needs without pulling in an imaging library
+func scaleImage(src image.Image, w, h int) *image.RGBA {
+	b := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	}
+	sw, sh := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for dy := 0; dy < h; dy++ {
+		y0 := dy * sh / h
+		y1 := max(y0+1, (dy+1)*sh/h)
+		for dx := 0; dx < w; dx++ {
+			x0 := dx * sw / w
+			x1 := max(x0+1, (dx+1)*sw/w)
+
+			var r, g, bl, a, n uint32
+			for y := y0; y < y1; y++ {
+				i := rgba.PixOffset(x0, y)
+				for x := x0; x < x1; x++ {
+					r += uint32(rgba.Pix[i])
+					g += uint32(rgba.Pix[i+1])
+					bl += uint32(rgba.Pix[i+2])
+					a += uint32(rgba.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+
+			o := dst.PixOffset(dx, dy)
+			dst.Pix[o] = uint8(r / n)
+			dst.Pix[o+1] = uint8(g / n)
+			dst.Pix[o+2] = uint8(bl / n)
+			dst.Pix[o+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// route to proxy Spotify CDN images through the server, i.e. /img?url=https://i.scdn.co/image/...&w=300
+// serving them same-origin keeps the download canvas untainted, and the long-lived headers let browsers skip repeat fetches
+func handleImageProxy(w http.ResponseWriter, r *http.Request) {
+	imageURL := r.URL.Query().Get("url")
+	if err := validateImageURL(imageURL); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	width := 0
+	if v := r.URL.Query().Get("w"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minImageWidth || n > maxImageWidth {
+			writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("w must be between %d and %d", minImageWidth, maxImageWidth))
+			return
+		}
+		width = n
+	}
+
+	data, err := imgCache.Fetch(r.Context(), imageURL, width)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "upstream_error", "Error fetching image")
+		log.Printf("Error fetching image %s: %v", imageURL, err)
+		return
+	}
+
+	// the cache key covers the url and width and Spotify image urls are content addressed, so the response never changes
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+imageCacheKey(imageURL, width)+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
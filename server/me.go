@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// routes for the caller's own data, what Wallify keeps about them and a way to remove all of it
+
+// work out whose session this is, sessions from before tokens recorded their user ask Spotify instead
+func userIDForToken(ctx context.Context, token *Token) (string, error) {
+	if token.UserID != "" {
+		return token.UserID, nil
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://api.spotify.com/v1/me", nil)
+	body, err := makeSpotifyRequest(req, token.AccessToken, token.TokenID, "profile", 0)
+	if err != nil {
+		return "", err
+	}
+	var profile struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &profile); err != nil || profile.ID == "" {
+		return "", fmt.Errorf("error reading user ID from profile: %v", err)
+	}
+	return profile.ID, nil
+}
+
+// a session as shown to its owner, the Spotify tokens behind it are never sent back out and neither is the key itself,
+// an export gets saved and passed around and a full key would be a working login
+type mySession struct {
+	Key      string    `json:"key"` // the start of the session key, enough to tell sessions apart
+	IssuedAt time.Time `json:"issuedAt"`
+	Current  bool      `json:"current"`        // the session making this request
+	Feed     string    `json:"feed,omitempty"` // the wallpaper feed this session belongs to, feeds get their own
+}
+
+type myData struct {
+	User        *User          `json:"user"`
+	Preferences *Preferences   `json:"preferences"`
+	Sessions    []mySession    `json:"sessions"`
+	Waitlist    *waitlistEntry `json:"waitlist"`
+	Presets     []*Preset      `json:"presets"`
+	Shares      []*Share       `json:"shares"`
+	Feeds       []*Feed        `json:"feeds"`
+	Notes       []string       `json:"notes"`
+}
+
+// everything stored about the caller, as JSON
+func handleMyData(w http.ResponseWriter, r *http.Request) {
+	token := tokenFromContext(r.Context())
+	userID, err := userIDForToken(r.Context(), token)
+	if err != nil {
+		log.Printf("Error identifying user for data export: %v", err)
+		writeSpotifyError(w, err, "Error identifying your Spotify account")
+		return
+	}
+
+	data := myData{
+		Sessions: []mySession{},
+		Notes: []string{
+			"Each session also holds the Spotify access and refresh tokens issued when you logged in, they are used only to read your top artists, top tracks and profile and are not shown here",
+			"Top artists, tracks and images are fetched from Spotify on demand and not stored against your account",
+			"Session keys are cut short since a full key works as a login, sessions with a feed are the ones your wallpaper feeds use and end when the feed is revoked",
+		},
+	}
+
+	data.User, err = users.Get(r.Context(), userID)
+	if err != nil && !errors.Is(err, errUserNotFound) {
+		log.Printf("Error fetching user %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching your data")
+		return
+	}
+
+	if data.User != nil {
+		data.Preferences, err = users.GetPreferences(r.Context(), userID)
+		if err != nil {
+			log.Printf("Error fetching preferences for %s: %v", userID, err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching your data")
+			return
+		}
+	}
+
+	if data.User != nil {
+		entries, err := waitlistEntriesFor(r.Context(), data.User)
+		if err != nil {
+			log.Printf("Error fetching waitlist entry: %v", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching your data")
+			return
+		}
+		if len(entries) > 0 {
+			data.Waitlist = entries[0]
+		}
+	}
+
+	data.Presets, err = presetsOwnedBy(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error fetching presets for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching your data")
+		return
+	}
+	if data.Presets == nil {
+		data.Presets = []*Preset{}
+	}
+
+	data.Shares, err = shares.ListOwnedBy(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error fetching shares for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching your data")
+		return
+	}
+
+	data.Feeds, err = feeds.ListOwnedBy(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error fetching feeds for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching your data")
+		return
+	}
+
+	sessions, err := tokens.List(r.Context())
+	if err != nil {
+		log.Printf("Error listing sessions: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching your data")
+		return
+	}
+	feedSessions := make(map[string]string, len(data.Feeds))
+	for _, feed := range data.Feeds {
+		feedSessions[feed.TokenKey] = feed.ID
+	}
+	for _, session := range sessions {
+		if session.UserID == userID || session.TokenID == token.TokenID {
+			data.Sessions = append(data.Sessions, mySession{
+				Key:      maskToken(session.TokenID),
+				IssuedAt: time.Unix(session.Expiration, 0).UTC(),
+				Current:  session.TokenID == token.TokenID,
+				Feed:     feedSessions[session.TokenID],
+			})
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Disposition", `attachment; filename="wallify-data.json"`)
+	writeJSON(w, http.StatusOK, data)
+}
+
+// delete everything stored about the caller, this ends every one of their sessions including the one making the request
+func handleDeleteMe(w http.ResponseWriter, r *http.Request) {
+	token := tokenFromContext(r.Context())
+	userID, err := userIDForToken(r.Context(), token)
+	if err != nil {
+		log.Printf("Error identifying user for deletion: %v", err)
+		writeSpotifyError(w, err, "Error identifying your Spotify account")
+		return
+	}
+
+	// a user without a record still gets their sessions cleared
+	user, err := users.Get(r.Context(), userID)
+	if errors.Is(err, errUserNotFound) {
+		user, err = &User{ID: userID}, nil
+	}
+	if err != nil {
+		log.Printf("Error fetching user %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error deleting your data")
+		return
+	}
+
+	deletion, err := deleteUserData(r.Context(), user, "self", token.TokenID)
+	if err != nil {
+		log.Printf("Error deleting data for user %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error deleting your data")
+		return
+	}
+
+	log.Printf("User %s deleted their data, %d sessions ended", userID, deletion.Sessions)
+	writeJSON(w, http.StatusOK, deletion)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	smithymiddleware "github.com/aws/smithy-go/middleware"
+)
+
+// a small Prometheus text format implementation, the server only needs counters, histograms and gauges
+// so this avoids pulling in the full client library
+
+type collector interface {
+	collect(w io.Writer)
+}
+
+type registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+var metrics = &registry{}
+
+func (reg *registry) register(c collector) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.collectors = append(reg.collectors, c)
+}
+
+func (reg *registry) write(w io.Writer) {
+	reg.mu.Lock()
+	collectors := append([]collector(nil), reg.collectors...)
+	reg.mu.Unlock()
+	for _, c := range collectors {
+		c.collect(w)
+	}
+}
+
+// labelled series are keyed by their joined label values
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, extra[i], labelEscaper.Replace(extra[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	values []string
+	value  float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, series: make(map[string]*counterSeries)}
+	metrics.register(c)
+	return c
+}
+
+func (c *counterVec) add(v float64, values ...string) {
+	key := seriesKey(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{values: values}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+func (c *counterVec) collect(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.values), formatFloat(s.value))
+	}
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64 // per bucket, made cumulative when written
+	sum    float64
+	count  uint64
+}
+
+// default latency buckets in seconds, same as the Prometheus client defaults
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	metrics.register(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := seriesKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) since(start time.Time, values ...string) {
+	h.observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) collect(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.values), s.count)
+	}
+}
+
+// gauge computed when scraped
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, fn: fn}
+	metrics.register(g)
+	return g
+}
+
+func (g *gaugeFunc) collect(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.fn()))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// the metrics themselves
+var (
+	httpRequests = newCounterVec("wallify_http_requests_total",
+		"HTTP requests served, by route, method and status.", "route", "method", "status")
+	httpDuration = newHistogramVec("wallify_http_request_duration_seconds",
+		"HTTP request latency, by route, method and status.", latencyBuckets, "route", "method", "status")
+
+	spotifyRequests = newCounterVec("wallify_spotify_requests_total",
+		"Outbound Spotify calls, by endpoint and status (error for calls that never got a response).", "endpoint", "status")
+	spotifyDuration = newHistogramVec("wallify_spotify_request_duration_seconds",
+		"Outbound Spotify call latency, by endpoint and status.", latencyBuckets, "endpoint", "status")
+
+	dynamoDuration = newHistogramVec("wallify_dynamodb_request_duration_seconds",
+		"DynamoDB call latency, by operation.", latencyBuckets, "operation")
+	dynamoErrors = newCounterVec("wallify_dynamodb_errors_total",
+		"DynamoDB calls that failed, by operation.", "operation")
+
+	tokenRefreshes = newCounterVec("wallify_token_refreshes_total",
+		"Spotify access token refreshes, by result.", "result")
+
+	tokenCacheRequests = newCounterVec("wallify_token_cache_requests_total",
+		"Token lookups served by the in-process cache, by result (hit or miss).", "result")
+
+	rateLimited = newCounterVec("wallify_rate_limited_total",
+		"Requests turned away with a 429, by limiter.", "limiter")
+
+	userLogins = newCounterVec("wallify_user_logins_total",
+		"Logins processed, split into new and returning users, plus those turned away for not being on the Spotify allowlist.", "user")
+
+	_ = newGaugeFunc("wallify_active_sessions",
+		"Sessions that made an authenticated request in the last 30 minutes.", func() float64 {
+			return float64(activeSessions.count())
+		})
+)
+
+// record which sessions have been used recently so the active sessions gauge can count them
+// it also remembers which sessions were already counted as active today for the daily stats, a restart forgets that so
+// a session can be counted twice on the day of a deploy
+type sessionTracker struct {
+	window time.Duration
+
+	mu         sync.Mutex
+	lastSeen   map[string]time.Time
+	day        string
+	countedDay map[string]bool
+}
+
+var activeSessions = &sessionTracker{window: 30 * time.Minute, lastSeen: make(map[string]time.Time)}
+
+// mark a session as used, returns true the first time it's used on a given (UTC) day
+func (t *sessionTracker) touch(tokenKey string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.lastSeen[tokenKey] = now
+
+	if day := statDay(now); day != t.day {
+		t.day = day
+		t.countedDay = make(map[string]bool)
+	}
+	if t.countedDay[tokenKey] {
+		return false
+	}
+	t.countedDay[tokenKey] = true
+	return true
+}
+
+// stop counting a session that has ended
+func (t *sessionTracker) forget(tokenKey string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.lastSeen, tokenKey)
+}
+
+// count the sessions inside the window, dropping the ones that have aged out
+func (t *sessionTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cutoff := time.Now().Add(-t.window)
+	for key, seen := range t.lastSeen {
+		if seen.Before(cutoff) {
+			delete(t.lastSeen, key)
+		}
+	}
+	return len(t.lastSeen)
+}
+
+// record request counts and latency per route, unmatched paths share a single label so scanners can't blow up the series count
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := r.Pattern
+		switch {
+		case r.Method == http.MethodOptions && route == "":
+			route = "preflight"
+		case route == "" || route == "/":
+			route = "unmatched"
+		}
+		httpRequests.inc(route, r.Method, strconv.Itoa(status))
+		httpDuration.since(start, route, r.Method, strconv.Itoa(status))
+	})
+}
+
+// transport that records every outbound Spotify call, labelled by a fixed set of endpoint names
+type spotifyMetricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t spotifyMetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	endpoint := spotifyEndpoint(req)
+	spotifyRequests.inc(endpoint, status)
+	spotifyDuration.since(start, endpoint, status)
+	return resp, err
+}
+
+func spotifyEndpoint(req *http.Request) string {
+	switch {
+	case req.URL.Host == "accounts.spotify.com" && req.URL.Path == "/api/token":
+		return "token"
+	case req.URL.Host == "api.spotify.com" && req.URL.Path == "/v1/me":
+		return "me"
+	case req.URL.Host == "api.spotify.com" && req.URL.Path == "/v1/me/top/artists":
+		return "top_artists"
+	case req.URL.Host == "api.spotify.com" && req.URL.Path == "/v1/me/top/tracks":
+		return "top_tracks"
+	case allowedImageHosts[req.URL.Hostname()]:
+		return "image_cdn"
+	}
+	return "other"
+}
+
+// AWS SDK middleware that times every DynamoDB operation, added through the config's APIOptions
+// it sits in the initialize step after the SDK records the operation name, so a call's retries are timed as one operation
+func withDynamoMetrics(stack *smithymiddleware.Stack) error {
+	return stack.Initialize.Add(smithymiddleware.InitializeMiddlewareFunc("WallifyMetrics",
+		func(ctx context.Context, in smithymiddleware.InitializeInput, next smithymiddleware.InitializeHandler) (smithymiddleware.InitializeOutput, smithymiddleware.Metadata, error) {
+			start := time.Now()
+			out, md, err := next.HandleInitialize(ctx, in)
+
+			operation := awsmiddleware.GetOperationName(ctx)
+			dynamoDuration.since(start, operation)
+			if err != nil {
+				dynamoErrors.inc(operation)
+			}
+			return out, md, err
+		}), smithymiddleware.After)
+}
+
+// route serving the metrics in Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write(w)
+}
+
+// optionally lock /metrics behind a bearer token, set METRICS_TOKEN to enable it
+func requireMetricsToken(token string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given := []byte(r.Header.Get("Authorization"))
+			if token != "" && subtle.ConstantTimeCompare(given, []byte("Bearer "+token)) != 1 {
+				writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid or missing metrics token")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+type contextKey int
+
+const tokenContextKey contextKey = iota
+
+// response writer that remembers the status code so middleware can report it after the handler returns
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// lets http.ResponseController reach the underlying writer for flushing and deadlines
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// log one line per request with the matched route, status and duration
+func withLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		log.Printf("%s %s (route %q) -> %d, %d bytes in %v", r.Method, r.URL.Path, r.Pattern, rec.status, rec.bytes, time.Since(start))
+	})
+}
+
+// turn a panicking handler into a 500 instead of a dropped connection, logging the stack for debugging
+// http.ErrAbortHandler is the standard library's way of deliberately aborting a response, so that one is passed through
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			log.Printf("Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			// if the handler already started the response the status can't be changed, the client just gets a truncated body
+			if rec.status == 0 {
+				writeError(rec, http.StatusInternalServerError, "internal_error", "Internal server error")
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// look up the session from the x-token-key header and make it available to the handler, rejecting the request otherwise
+func requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenKey := r.Header.Get("x-token-key")
+		if tokenKey == "" {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid or missing token")
+			return
+		}
+
+		token, err := tokens.Fetch(r.Context(), tokenKey)
+		if err != nil {
+			log.Printf("Invalid or missing token: %v", err)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid or missing token")
+			return
+		}
+
+		if activeSessions.touch(tokenKey) {
+			recordActiveSession()
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey, token)))
+	})
+}
+
+// get the token stored by requireToken
+func tokenFromContext(ctx context.Context) *Token {
+	token, _ := ctx.Value(tokenContextKey).(*Token)
+	return token
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strconv"
+)
+
+// rank-weighted mosaic layouts
+// the top items get bigger tiles, 3x3 for #1, 2x2 for #2 to #5 and 1x1 for everyone else, packed into the grid with no
+// gaps, a seed decides where the big tiles land so the same settings always give the same arrangement
+// the server works out the tile coordinates and hands them to the web app in the top content response, so the app and
+// server rendered wallpapers are always the same mosaic
+
+const (
+	layoutGrid   = "grid"
+	layoutMosaic = "mosaic"
+
+	maxMosaicSeed = 1<<31 - 1 // seeds have to survive a round trip through a JavaScript number
+)
+
+// a tile of the mosaic, x and y are the grid cell of its top left corner and size is how many cells it spans each way
+type mosaicTile struct {
+	Rank int `json:"rank"`
+	X    int `json:"x"`
+	Y    int `json:"y"`
+	Size int `json:"size"`
+}
+
+type mosaicLayout struct {
+	Columns int          `json:"columns"`
+	Rows    int          `json:"rows"`
+	Seed    int64        `json:"seed"`
+	Tiles   []mosaicTile `json:"tiles"` // by rank, ranks without an item are drawn as placeholders like an empty grid tile
+}
+
+// how many cells a rank spans each way before it's fitted to the grid
+func mosaicSize(rank int) int {
+	switch {
+	case rank == 1:
+		return 3
+	case rank <= 5:
+		return 2
+	}
+	return 1
+}
+
+// pack a cols x rows grid, ranks start at firstRank so a later page of items is a plain grid
+// screens splits the columns into equal blocks that no big tile crosses, for multi-monitor spans, and the 1x1 tiles fill
+// in rank order block by block, row by row, the same order a plain grid fills in
+// big tiles shrink when they'd take more than half the grid between them, don't fit the grid, or land somewhere with no
+// room left for them, so every cell always ends up covered by exactly one tile
+func packMosaic(cols, rows, screens, firstRank int, seed int64) []mosaicTile {
+	blockCols := cols / screens
+	budget := cols * rows / 2
+	used := 0
+	taken := make([][]bool, rows)
+	for y := range taken {
+		taken[y] = make([]bool, cols)
+	}
+	fits := func(x, y, size int) bool {
+		if x+size > cols || y+size > rows || x/blockCols != (x+size-1)/blockCols {
+			return false
+		}
+		for dy := 0; dy < size; dy++ {
+			for dx := 0; dx < size; dx++ {
+				if taken[y+dy][x+dx] {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	var tiles []mosaicTile
+	placed := map[int]bool{}
+	for rank := firstRank; mosaicSize(rank) > 1; rank++ {
+		size := min(mosaicSize(rank), blockCols, rows)
+		for size > 1 && used+size*size > budget {
+			size--
+		}
+		for ; size > 1; size-- {
+			var spots [][2]int
+			for y := 0; y < rows; y++ {
+				for x := 0; x < cols; x++ {
+					if fits(x, y, size) {
+						spots = append(spots, [2]int{x, y})
+					}
+				}
+			}
+			if len(spots) == 0 {
+				continue
+			}
+			spot := spots[rng.Intn(len(spots))]
+			for dy := 0; dy < size; dy++ {
+				for dx := 0; dx < size; dx++ {
+					taken[spot[1]+dy][spot[0]+dx] = true
+				}
+			}
+			tiles = append(tiles, mosaicTile{Rank: rank, X: spot[0], Y: spot[1], Size: size})
+			placed[rank] = true
+			used += size * size
+			break
+		}
+	}
+
+	rank := firstRank
+	for block := 0; block < screens; block++ {
+		for y := 0; y < rows; y++ {
+			for x := block * blockCols; x < (block+1)*blockCols; x++ {
+				if taken[y][x] {
+					continue
+				}
+				for placed[rank] {
+					rank++
+				}
+				tiles = append(tiles, mosaicTile{Rank: rank, X: x, Y: y, Size: 1})
+				rank++
+			}
+		}
+	}
+
+	// by rank, the big tiles were placed first
+	sorted := make([]mosaicTile, len(tiles))
+	for _, t := range tiles {
+		sorted[t.Rank-firstRank] = t
+	}
+	return sorted
+}
+
+// the tiles a set of preferences lays out on its grid, a plain grid is a mosaic of nothing but 1x1 tiles
+func layoutTiles(settings *Preferences, cols, rows, screens int) []mosaicTile {
+	if settings.Layout == layoutMosaic {
+		return packMosaic(cols, rows, screens, 1, settings.MosaicSeed)
+	}
+	tiles := make([]mosaicTile, 0, cols*rows)
+	blockCols := cols / screens
+	for block := 0; block < screens; block++ {
+		for y := 0; y < rows; y++ {
+			for x := block * blockCols; x < (block+1)*blockCols; x++ {
+				tiles = append(tiles, mosaicTile{Rank: len(tiles) + 1, X: x, Y: y, Size: 1})
+			}
+		}
+	}
+	return tiles
+}
+
+// read the layout query parameters for the top content routes, ?columns=&rows= is the grid the page fills and
+// ?layout=mosaic, which needs them, lays it out as a mosaic with an optional &seed=, ranks follow the page's offset
+// returns the mosaic, nil for the plain grid, and how many of the page's items fill the grid, 0 if no grid was given
+func parseLayoutQuery(query url.Values, offset int) (*mosaicLayout, int, error) {
+	mosaic := false
+	switch query.Get("layout") {
+	case "", layoutGrid:
+	case layoutMosaic:
+		mosaic = true
+	default:
+		return nil, 0, fmt.Errorf("layout must be %q or %q", layoutGrid, layoutMosaic)
+	}
+	if !mosaic && query.Get("columns") == "" && query.Get("rows") == "" {
+		return nil, 0, nil
+	}
+
+	columns, errX := strconv.Atoi(query.Get("columns"))
+	rows, errY := strconv.Atoi(query.Get("rows"))
+	if errX != nil || errY != nil || columns < 1 || rows < 1 || columns*rows > maxTopContent {
+		return nil, 0, fmt.Errorf("columns and rows must both be given, holding at most %d tiles", maxTopContent)
+	}
+	if !mosaic {
+		return nil, columns * rows, nil
+	}
+	var seed int64
+	if v := query.Get("seed"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 || n > maxMosaicSeed {
+			return nil, 0, fmt.Errorf("seed must be between 0 and %d", maxMosaicSeed)
+		}
+		seed = n
+	}
+	layout := &mosaicLayout{
+		Columns: columns,
+		Rows:    rows,
+		Seed:    seed,
+		Tiles:   packMosaic(columns, rows, 1, offset+1, seed),
+	}
+	return layout, len(layout.Tiles), nil
+}
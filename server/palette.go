@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// color palettes for artwork and the color-aware orderings built on them
+// a palette is the artwork's main colors by how much of it they cover, worked out by k-means over a small copy of the
+// image fetched through the shared image cache, so each piece of art is downloaded and clustered once
+// orderings sort by each item's dominant color, the first color of its palette, and items without art always go last
+
+const (
+	paletteSize        = 5  // colors per palette
+	paletteSampleWidth = 64 // art is fetched this wide for palettes, plenty to find the main colors
+	paletteSamplePx    = 32 // and sampled at this size for clustering
+
+	orderRank       = "rank"
+	orderHue        = "hue"        // a rainbow sweep, with greys and near-blacks at the end from light to dark
+	orderBrightness = "brightness" // light to dark
+	orderCluster    = "cluster"    // similar colors grouped together, groups in rainbow order and ranked inside
+)
+
+var paletteOrders = []string{orderRank, orderHue, orderBrightness, orderCluster}
+
+// the render LRU works as well for palettes, kept as JSON by art url
+var paletteCache = newRenderCache(4096)
+
+type paletteColor struct {
+	Color string  `json:"color"` // #rrggbb
+	Share float64 `json:"share"` // fraction of the art it covers
+}
+
+// a color for clustering, 0 to 255 per channel
+type rgb struct{ r, g, b float64 }
+
+func (c rgb) dist(o rgb) float64 {
+	dr, dg, db := c.r-o.r, c.g-o.g, c.b-o.b
+	return dr*dr + dg*dg + db*db
+}
+
+func (c rgb) hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", uint8(c.r+0.5), uint8(c.g+0.5), uint8(c.b+0.5))
+}
+
+func parseRGB(hex string) rgb {
+	c := parseHexColor(hex)
+	return rgb{float64(c.R), float64(c.G), float64(c.B)}
+}
+
+// hue in degrees, HSL saturation and lightness from 0 to 1
+func (c rgb) hsl() (h, s, l float64) {
+	r, g, b := c.r/255, c.g/255, c.b/255
+	hi, lo := max(r, g, b), min(r, g, b)
+	l = (hi + lo) / 2
+	d := hi - lo
+	if d == 0 {
+		return 0, 0, l
+	}
+	s = d / (1 - math.Abs(2*l-1))
+	switch hi {
+	case r:
+		h = math.Mod((g-b)/d+6, 6)
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	return h * 60, s, l
+}
+
+// perceived brightness, Rec. 601 luma
+func (c rgb) luma() float64 {
+	return 0.299*c.r + 0.587*c.g + 0.114*c.b
+}
+
+// weighted k-means, the starting centers are picked farthest first from the heaviest point so the result only depends
+// on the input, returns the centers and the total weight each ended up with
+func kmeans(points []rgb, weights []float64, k int) ([]rgb, []float64) {
+	if len(points) == 0 {
+		return nil, nil
+	}
+	k = min(k, len(points))
+	heaviest := 0
+	for i, w := range weights {
+		if w > weights[heaviest] {
+			heaviest = i
+		}
+	}
+	centers := []rgb{points[heaviest]}
+	for len(centers) < k {
+		next, far := -1, 0.0
+		for i, p := range points {
+			d := math.Inf(1)
+			for _, c := range centers {
+				d = min(d, p.dist(c))
+			}
+			if d*weights[i] > far {
+				next, far = i, d*weights[i]
+			}
+		}
+		if next < 0 {
+			break // fewer distinct colors than k
+		}
+		centers = append(centers, points[next])
+	}
+
+	totals := make([]float64, len(centers))
+	for iter := 0; iter < 10; iter++ {
+		sums := make([]rgb, len(centers))
+		totals = make([]float64, len(centers))
+		for i, p := range points {
+			best := 0
+			for j, c := range centers {
+				if p.dist(c) < p.dist(centers[best]) {
+					best = j
+				}
+			}
+			w := weights[i]
+			sums[best].r += p.r * w
+			sums[best].g += p.g * w
+			sums[best].b += p.b * w
+			totals[best] += w
+		}
+		for j := range centers {
+			if totals[j] > 0 {
+				centers[j] = rgb{sums[j].r / totals[j], sums[j].g / totals[j], sums[j].b / totals[j]}
+			}
+		}
+	}
+	return centers, totals
+}
+
+// the main colors of an image, biggest share first, transparent pixels don't count
+func extractPalette(img image.Image) []paletteColor {
+	small := scaleImage(img, paletteSamplePx, paletteSamplePx)
+	var points []rgb
+	var weights []float64
+	for i := 0; i < len(small.Pix); i += 4 {
+		if small.Pix[i+3] < 128 {
+			continue
+		}
+		points = append(points, rgb{float64(small.Pix[i]), float64(small.Pix[i+1]), float64(small.Pix[i+2])})
+		weights = append(weights, 1)
+	}
+
+	centers, totals := kmeans(points, weights, paletteSize)
+	palette := []paletteColor{}
+	for j, c := range centers {
+		if totals[j] > 0 {
+			palette = append(palette, paletteColor{Color: c.hex(), Share: math.Round(totals[j]/float64(len(points))*100) / 100})
+		}
+	}
+	sort.SliceStable(palette, func(a, b int) bool { return palette[a].Share > palette[b].Share })
+	return palette
+}
+
+// the palette for a piece of art, nil if it can't be fetched
+func fetchPalette(ctx context.Context, imageURL string) []paletteColor {
+	if data, ok := paletteCache.Get(imageURL); ok {
+		var palette []paletteColor
+		if err := json.Unmarshal(data, &palette); err == nil {
+			return palette
+		}
+	}
+	img, err := imgCache.FetchImage(ctx, imageURL, paletteSampleWidth)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Error fetching image %s for its palette: %v", imageURL, err)
+		}
+		return nil
+	}
+	palette := extractPalette(img)
+	if data, err := json.Marshal(palette); err == nil {
+		paletteCache.Add(imageURL, data)
+	}
+	return palette
+}
+
+// palettes for a list of art urls in parallel, an empty url gets a nil palette
+func fetchPalettes(ctx context.Context, urls []string) [][]paletteColor {
+	out := make([][]paletteColor, len(urls))
+	sem := make(chan struct{}, renderFetchers)
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		if u == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			out[i] = fetchPalette(ctx, u)
+		}(i, u)
+	}
+	wg.Wait()
+	return out
+}
+
+// the order to show items in, as indexes into palettes, which are in rank order
+// the first keep items stay where they are, i.e. the ones a mosaic gives big tiles to
+func colorOrder(palettes [][]paletteColor, order string, keep int) []int {
+	perm := make([]int, len(palettes))
+	for i := range perm {
+		perm[i] = i
+	}
+	keep = min(keep, len(perm))
+	if order == "" || order == orderRank {
+		return perm
+	}
+
+	var colored, plain []int
+	for _, i := range perm[keep:] {
+		if len(palettes[i]) > 0 {
+			colored = append(colored, i)
+		} else {
+			plain = append(plain, i)
+		}
+	}
+	dominant := func(i int) rgb { return parseRGB(palettes[i][0].Color) }
+
+	switch order {
+	case orderHue:
+		sortByHue(colored, dominant)
+	case orderBrightness:
+		sort.SliceStable(colored, func(a, b int) bool { return dominant(colored[a]).luma() > dominant(colored[b]).luma() })
+	case orderCluster:
+		// sqrt(n) groups, i.e. 5 for a 5x5 grid and 10 for all 99, big enough to read as blocks of color
+		points := make([]rgb, len(colored))
+		weights := make([]float64, len(colored))
+		for n, i := range colored {
+			points[n], weights[n] = dominant(i), 1
+		}
+		k := max(1, int(math.Round(math.Sqrt(float64(len(colored))))))
+		centers, _ := kmeans(points, weights, k)
+		groups := make([]int, len(centers))
+		for g := range groups {
+			groups[g] = g
+		}
+		sortByHue(groups, func(g int) rgb { return centers[g] })
+		place := make([]int, len(centers))
+		for n, g := range groups {
+			place[g] = n
+		}
+		group := map[int]int{}
+		for n, i := range colored {
+			best := 0
+			for g, c := range centers {
+				if points[n].dist(c) < points[n].dist(centers[best]) {
+					best = g
+				}
+			}
+			group[i] = place[best]
+		}
+		// colored is still in rank order, so a stable sort by group keeps each group ranked
+		sort.SliceStable(colored, func(a, b int) bool { return group[colored[a]] < group[colored[b]] })
+	}
+
+	return append(append(perm[:keep:keep], colored...), plain...)
+}
+
+// rainbow order, colors too grey, dark or light to have a real hue go after the rest from light to dark
+func sortByHue(idx []int, color func(int) rgb) {
+	chromatic := func(c rgb) bool {
+		_, s, l := c.hsl()
+		return s >= 0.15 && l >= 0.08 && l <= 0.92
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		ca, cb := color(idx[a]), color(idx[b])
+		if chromatic(ca) != chromatic(cb) {
+			return chromatic(ca)
+		}
+		if !chromatic(ca) {
+			return ca.luma() > cb.luma()
+		}
+		ha, _, _ := ca.hsl()
+		hb, _, _ := cb.hsl()
+		return ha < hb
+	})
+}
+
+// pick a gradient from the palettes of the top items, which are in rank order
+// the two colors covering the most of the top ten's art win, vivid colors counting for more than greys so white borders
+// and black backdrops don't take over, as long as they're far enough apart to make a gradient, otherwise the main color
+// fades into a darker shade of itself
+func autoBackground(palettes [][]paletteColor) (string, string, bool) {
+	var points []rgb
+	var weights []float64
+	for i, palette := range palettes {
+		if i == 10 {
+			break
+		}
+		for _, c := range palette {
+			p := parseRGB(c.Color)
+			_, sat, _ := p.hsl()
+			points = append(points, p)
+			weights = append(weights, c.Share*(0.25+sat))
+		}
+	}
+	if len(points) == 0 {
+		return "", "", false
+	}
+
+	centers, totals := kmeans(points, weights, 4)
+	idx := make([]int, len(centers))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return totals[idx[a]] > totals[idx[b]] })
+	first := centers[idx[0]]
+	for _, i := range idx[1:] {
+		if totals[i] > 0 && first.dist(centers[i]) >= 60*60 {
+			return first.hex(), centers[i].hex(), true
+		}
+	}
+	darker := rgb{first.r * 0.45, first.g * 0.45, first.b * 0.45}
+	if first.hex() == darker.hex() {
+		darker = rgb{64, 64, 64} // already black
+	}
+	return first.hex(), darker.hex(), true
+}
+
+// how many of the first items a layout keeps in rank order, the mosaic's big tiles stay with the top ranks
+func keepRanked(layout string, firstRank int) int {
+	keep := 0
+	if layout == layoutMosaic {
+		for mosaicSize(firstRank+keep) > 1 {
+			keep++
+		}
+	}
+	return keep
+}
+
+// work out a layout's ordering and auto background for the art urls a wallpaper is drawn from, in rank order
+// returns the order to draw them in as indexes into urls, and the settings to draw with, a copy if the background was
+// picked
+func paletteLayout(ctx context.Context, urls []string, settings *Preferences) ([]int, *Preferences) {
+	if (settings.Order == "" || settings.Order == orderRank) && !settings.AutoBackground {
+		return colorOrder(make([][]paletteColor, len(urls)), orderRank, 0), settings
+	}
+	found := fetchPalettes(ctx, urls)
+	if settings.AutoBackground {
+		if c1, c2, ok := autoBackground(found); ok {
+			picked := *settings
+			picked.UseGradient, picked.Color1, picked.Color2 = true, c1, c2
+			settings = &picked
+		}
+	}
+	return colorOrder(found, settings.Order, keepRanked(settings.Layout, 1)), settings
+}
+
+// read the palette query parameters for the top content routes, ?palette=true adds each item's palette and a suggested
+// background, ?order= sorts the items that fill the grid by color and implies palette
+func parsePaletteQuery(query url.Values) (string, bool, error) {
+	order := query.Get("order")
+	if order == "" {
+		order = orderRank
+	}
+	if !validOrder(order) {
+		return "", false, fmt.Errorf("order must be one of %v", paletteOrders)
+	}
+	withPalette := order != orderRank
+	switch query.Get("palette") {
+	case "", "false":
+	case "true":
+		withPalette = true
+	default:
+		return "", false, fmt.Errorf("palette must be true or false")
+	}
+	return order, withPalette, nil
+}
+
+func validOrder(order string) bool {
+	for _, o := range paletteOrders {
+		if o == order {
+			return true
+		}
+	}
+	return false
+}
+
+// a background picked from the top items' art, sent with the top content so the app can use it
+type suggestedBackground struct {
+	Color1 string `json:"color1"`
+	Color2 string `json:"color2"`
+}
+
+// attach palettes to a page of items and sort the ones that fill the grid by color, fit is how many do, 0 for all
+// returns the items in their new order and the background their palettes suggest, nil if none of them has art
+func colorContent(ctx context.Context, items []contentItem, order string, fit, keep int) ([]contentItem, *suggestedBackground) {
+	urls := make([]string, len(items))
+	for i, item := range items {
+		if item.Image != nil {
+			urls[i] = item.Image.URL
+		}
+	}
+	found := fetchPalettes(ctx, urls)
+	for i := range items {
+		items[i].Palette = found[i]
+	}
+
+	if fit <= 0 || fit > len(items) {
+		fit = len(items)
+	}
+	ordered := make([]contentItem, 0, len(items))
+	for _, i := range colorOrder(found[:fit], order, keep) {
+		ordered = append(ordered, items[i])
+	}
+	ordered = append(ordered, items[fit:]...)
+
+	c1, c2, ok := autoBackground(found[:fit])
+	if !ok {
+		return ordered, nil
+	}
+	return ordered, &suggestedBackground{Color1: c1, Color2: c2}
+}
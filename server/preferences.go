@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// saved grid settings, everything in the Options panel, so a returning user gets their last layout back and the
+// server side renderer can draw the same grid
+// the document is stored on the user's record as JSON, version is the schema version so older documents can be
+// upgraded on read if the shape ever changes
+
+const preferencesVersion = 1
+
+type gridSize struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type Preferences struct {
+	Version               int        `json:"version"`
+	SelectionType         string     `json:"selectionType"` // artists or tracks
+	GridSize              gridSize   `json:"gridSize"`
+	IncludeProfilePicture bool       `json:"includeProfilePicture"`
+	ExcludeNullImages     bool       `json:"excludeNullImages"`
+	UseGradient           bool       `json:"useGradient"`
+	Color1                string     `json:"color1"` // #rrggbb
+	Color2                string     `json:"color2"`
+	Layout                string     `json:"layout,omitempty"`         // grid or mosaic, missing is the plain grid
+	MosaicSeed            int64      `json:"mosaicSeed,omitempty"`     // where a mosaic's big tiles go
+	Order                 string     `json:"order,omitempty"`          // rank, hue, brightness or cluster, missing is by rank
+	AutoBackground        bool       `json:"autoBackground,omitempty"` // pick the gradient from the art instead of color1 and color2
+	UpdatedAt             *time.Time `json:"updatedAt,omitempty"`      // set by the server, missing until something is saved
+}
+
+// what the Options panel starts with
+func defaultPreferences() *Preferences {
+	return &Preferences{
+		Version:       preferencesVersion,
+		SelectionType: "artists",
+		GridSize:      gridSize{X: 3, Y: 3},
+		Color1:        "#ffffff",
+		Color2:        "#000000",
+	}
+}
+
+var hexColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// check a document against the same rules the Options panel enforces
+func (p *Preferences) validate() error {
+	if p.Version != preferencesVersion {
+		return fmt.Errorf("version must be %d", preferencesVersion)
+	}
+	if p.SelectionType != "artists" && p.SelectionType != "tracks" {
+		return errors.New("selectionType must be artists or tracks")
+	}
+	if p.GridSize.X < 1 || p.GridSize.Y < 1 {
+		return errors.New("gridSize x and y must be positive")
+	}
+	if p.GridSize.X*p.GridSize.Y > maxTopContent {
+		return fmt.Errorf("gridSize can hold at most %d items", maxTopContent)
+	}
+	if !hexColor.MatchString(p.Color1) || !hexColor.MatchString(p.Color2) {
+		return errors.New("color1 and color2 must be hex colors like #1ed760")
+	}
+	// a gradient between one color twice is just a flat background drawn the slow way
+	if p.UseGradient && strings.EqualFold(p.Color1, p.Color2) {
+		return errors.New("a gradient needs two different colors")
+	}
+	if p.Layout != "" && p.Layout != layoutGrid && p.Layout != layoutMosaic {
+		return fmt.Errorf("layout must be %q or %q", layoutGrid, layoutMosaic)
+	}
+	if p.MosaicSeed < 0 || p.MosaicSeed > maxMosaicSeed {
+		return fmt.Errorf("mosaicSeed must be between 0 and %d", maxMosaicSeed)
+	}
+	if p.Order != "" && !validOrder(p.Order) {
+		return fmt.Errorf("order must be one of %v", paletteOrders)
+	}
+	return nil
+}
+
+// parse a stored document, bringing older versions up to date, there's only the one version so far
+func decodePreferences(doc string) (*Preferences, error) {
+	prefs := &Preferences{}
+	if err := json.Unmarshal([]byte(doc), prefs); err != nil {
+		return nil, fmt.Errorf("error parsing stored preferences: %w", err)
+	}
+	if prefs.Version != preferencesVersion {
+		return nil, fmt.Errorf("stored preferences have unknown version %d", prefs.Version)
+	}
+	return prefs, nil
+}
+
+// the caller's saved preferences, or the defaults if they haven't saved any
+func handleGetPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+
+	prefs, err := users.GetPreferences(r.Context(), userID)
+	if errors.Is(err, errUserNotFound) {
+		prefs, err = nil, nil
+	}
+	if err != nil {
+		log.Printf("Error fetching preferences for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching preferences")
+		return
+	}
+	if prefs == nil {
+		prefs = defaultPreferences()
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+// replace the caller's preferences with a full, valid document
+func handlePutPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+
+	prefs := &Preferences{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(prefs); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Request body must be a preferences document")
+		return
+	}
+	if err := prefs.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_preferences", err.Error())
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	prefs.UpdatedAt = &now
+
+	err := users.PutPreferences(r.Context(), userID, prefs)
+	if errors.Is(err, errUserNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "No user record to save preferences on, log in again")
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving preferences for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error saving preferences")
+		return
+	}
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+func preferencesUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userID, err := userIDForToken(r.Context(), tokenFromContext(r.Context()))
+	if err != nil {
+		log.Printf("Error identifying user for preferences: %v", err)
+		writeSpotifyError(w, err, "Error identifying your Spotify account")
+		return "", false
+	}
+	return userID, true
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// named layout presets, i.e. "phone dark" or "desktop gradient", on top of the one saved set of preferences
+// a preset can be published to the public gallery, where anyone logged in can clone it into their own presets
+// presets get their own table next to the users table, keyed by a short random ID with the owner's Spotify ID on each
+// row, so the gallery and clone counts don't mean rewriting user records
+
+const (
+	maxPresetsPerUser  = 20
+	maxPresetNameRunes = 40
+	defaultGalleryPage = 20
+	maxGalleryPage     = 50
+)
+
+var errPresetNotFound = errors.New("preset not found")
+
+type Preset struct {
+	ID         string      `json:"id"`
+	OwnerID    string      `json:"-"` // never sent out, the gallery shouldn't say who made what
+	Name       string      `json:"name"`
+	Settings   Preferences `json:"settings"`
+	Published  bool        `json:"published"`
+	Clones     int         `json:"clones"`
+	ClonedFrom string      `json:"clonedFrom,omitempty"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	UpdatedAt  time.Time   `json:"updatedAt"`
+}
+
+type presetStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+var presets *presetStore
+
+// short URL safe ID, 9 random bytes come out as 12 characters
+func newShortID() (string, error) {
+	b := make([]byte, 9)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating id: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// store a new preset under a fresh ID, the ID is filled in on the preset
+func (s *presetStore) Create(ctx context.Context, preset *Preset) error {
+	doc, err := json.Marshal(preset.Settings)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		id, err := newShortID()
+		if err != nil {
+			return err
+		}
+		item := map[string]types.AttributeValue{
+			"PresetID":  &types.AttributeValueMemberS{Value: id},
+			"OwnerID":   &types.AttributeValueMemberS{Value: preset.OwnerID},
+			"Name":      &types.AttributeValueMemberS{Value: preset.Name},
+			"Settings":  &types.AttributeValueMemberS{Value: string(doc)},
+			"Published": &types.AttributeValueMemberBOOL{Value: preset.Published},
+			"Clones":    &types.AttributeValueMemberN{Value: strconv.Itoa(preset.Clones)},
+			"CreatedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(preset.CreatedAt.Unix(), 10)},
+			"UpdatedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(preset.UpdatedAt.Unix(), 10)},
+		}
+		if preset.ClonedFrom != "" {
+			item["ClonedFrom"] = &types.AttributeValueMemberS{Value: preset.ClonedFrom}
+		}
+		_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(s.table),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(PresetID)"),
+		})
+		var taken *types.ConditionalCheckFailedException
+		if errors.As(err, &taken) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error creating preset: %w", err)
+		}
+		preset.ID = id
+		return nil
+	}
+	return errors.New("error creating preset: no free id")
+}
+
+// a single preset, errPresetNotFound if there's no such ID
+func (s *presetStore) Get(ctx context.Context, id string) (*Preset, error) {
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"PresetID": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching preset: %w", err)
+	}
+	if result.Item == nil {
+		return nil, errPresetNotFound
+	}
+	return presetFromItem(result.Item)
+}
+
+// write the editable fields back, the clone count is left alone since other users bump it
+func (s *presetStore) Update(ctx context.Context, preset *Preset) error {
+	doc, err := json.Marshal(preset.Settings)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"PresetID": &types.AttributeValueMemberS{Value: preset.ID},
+		},
+		UpdateExpression:    aws.String("SET #name = :name, Settings = :settings, Published = :published, UpdatedAt = :updatedAt"),
+		ConditionExpression: aws.String("attribute_exists(PresetID)"),
+		ExpressionAttributeNames: map[string]string{
+			"#name": "Name", // reserved word in DynamoDB expressions
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":name":      &types.AttributeValueMemberS{Value: preset.Name},
+			":settings":  &types.AttributeValueMemberS{Value: string(doc)},
+			":published": &types.AttributeValueMemberBOOL{Value: preset.Published},
+			":updatedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(preset.UpdatedAt.Unix(), 10)},
+		},
+	})
+	var missing *types.ConditionalCheckFailedException
+	if errors.As(err, &missing) {
+		return errPresetNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error updating preset: %w", err)
+	}
+	return nil
+}
+
+// count a clone against the preset it was copied from
+func (s *presetStore) AddClone(ctx context.Context, id string) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"PresetID": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("ADD Clones :one"),
+		ConditionExpression: aws.String("attribute_exists(PresetID)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	var missing *types.ConditionalCheckFailedException
+	if errors.As(err, &missing) {
+		return errPresetNotFound
+	}
+	return err
+}
+
+// remove a preset, returns false if there wasn't one
+func (s *presetStore) Delete(ctx context.Context, id string) (bool, error) {
+	result, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"PresetID": &types.AttributeValueMemberS{Value: id},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return false, fmt.Errorf("error deleting preset: %w", err)
+	}
+	return result.Attributes != nil, nil
+}
+
+// every preset, filtered by keep if it's set, the table stays small enough that a scan is fine
+func (s *presetStore) List(ctx context.Context, keep func(*Preset) bool) ([]*Preset, error) {
+	var all []*Preset
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{TableName: aws.String(s.table)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning presets: %w", err)
+		}
+		for _, item := range page.Items {
+			preset, err := presetFromItem(item)
+			if err != nil {
+				log.Printf("Skipping unreadable preset: %v", err)
+				continue
+			}
+			if keep == nil || keep(preset) {
+				all = append(all, preset)
+			}
+		}
+	}
+	return all, nil
+}
+
+// a user's own presets, oldest first so the list doesn't reshuffle as they edit
+func presetsOwnedBy(ctx context.Context, userID string) ([]*Preset, error) {
+	owned, err := presets.List(ctx, func(p *Preset) bool { return p.OwnerID == userID })
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(owned, func(i, j int) bool {
+		if !owned[i].CreatedAt.Equal(owned[j].CreatedAt) {
+			return owned[i].CreatedAt.Before(owned[j].CreatedAt)
+		}
+		return owned[i].ID < owned[j].ID
+	})
+	return owned, nil
+}
+
+func presetFromItem(item map[string]types.AttributeValue) (*Preset, error) {
+	preset := &Preset{}
+	if v, ok := item["PresetID"].(*types.AttributeValueMemberS); ok {
+		preset.ID = v.Value
+	}
+	if v, ok := item["OwnerID"].(*types.AttributeValueMemberS); ok {
+		preset.OwnerID = v.Value
+	}
+	if v, ok := item["Name"].(*types.AttributeValueMemberS); ok {
+		preset.Name = v.Value
+	}
+	if v, ok := item["Settings"].(*types.AttributeValueMemberS); ok {
+		settings, err := decodePreferences(v.Value)
+		if err != nil {
+			return nil, fmt.Errorf("preset %s: %w", preset.ID, err)
+		}
+		preset.Settings = *settings
+	}
+	if v, ok := item["Published"].(*types.AttributeValueMemberBOOL); ok {
+		preset.Published = v.Value
+	}
+	if v, ok := item["Clones"].(*types.AttributeValueMemberN); ok {
+		preset.Clones, _ = strconv.Atoi(v.Value)
+	}
+	if v, ok := item["ClonedFrom"].(*types.AttributeValueMemberS); ok {
+		preset.ClonedFrom = v.Value
+	}
+	if v, ok := item["CreatedAt"].(*types.AttributeValueMemberN); ok {
+		seconds, _ := strconv.ParseInt(v.Value, 10, 64)
+		preset.CreatedAt = time.Unix(seconds, 0).UTC()
+	}
+	if v, ok := item["UpdatedAt"].(*types.AttributeValueMemberN); ok {
+		seconds, _ := strconv.ParseInt(v.Value, 10, 64)
+		preset.UpdatedAt = time.Unix(seconds, 0).UTC()
+	}
+	return preset, nil
+}
+
+// what the create and update routes take, settings use the same document and rules as saved preferences
+type presetRequest struct {
+	Name      string       `json:"name"`
+	Settings  *Preferences `json:"settings"`
+	Published bool         `json:"published"`
+}
+
+func decodePresetRequest(w http.ResponseWriter, r *http.Request) (*presetRequest, bool) {
+	req := &presetRequest{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Request body must be a preset with a name and settings")
+		return nil, false
+	}
+	name, err := presetName(req.Name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_preset", err.Error())
+		return nil, false
+	}
+	req.Name = name
+	if req.Settings == nil {
+		writeError(w, http.StatusBadRequest, "invalid_preset", "settings are required")
+		return nil, false
+	}
+	if err := req.Settings.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_preset", err.Error())
+		return nil, false
+	}
+	// the preset's own timestamps say when it changed
+	req.Settings.UpdatedAt = nil
+	return req, true
+}
+
+// tidy up and check a preset name
+func presetName(name string) (string, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return "", errors.New("name is required")
+	}
+	if utf8.RuneCountInString(name) > maxPresetNameRunes {
+		return "", fmt.Errorf("name must be at most %d characters", maxPresetNameRunes)
+	}
+	return name, nil
+}
+
+// names are unique per owner, ignoring case, so the Options panel can list them by name
+func presetNameTaken(owned []*Preset, name, exceptID string) bool {
+	for _, preset := range owned {
+		if preset.ID != exceptID && strings.EqualFold(preset.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// the caller's presets
+func handleListPresets(w http.ResponseWriter, r *http.Request) {
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+	owned, err := presetsOwnedBy(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing presets for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching presets")
+		return
+	}
+	if owned == nil {
+		owned = []*Preset{}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, owned)
+}
+
+// save a new named preset
+func handleCreatePreset(w http.ResponseWriter, r *http.Request) {
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodePresetRequest(w, r)
+	if !ok {
+		return
+	}
+
+	owned, err := presetsOwnedBy(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing presets for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error saving preset")
+		return
+	}
+	if !checkPresetRoom(w, owned, req.Name, "") {
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	preset := &Preset{
+		OwnerID:   userID,
+		Name:      req.Name,
+		Settings:  *req.Settings,
+		Published: req.Published,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := presets.Create(r.Context(), preset); err != nil {
+		log.Printf("Error creating preset for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error saving preset")
+		return
+	}
+	writeJSON(w, http.StatusCreated, preset)
+}
+
+// a preset the caller owns, or anyone's published one
+func handleGetPreset(w http.ResponseWriter, r *http.Request) {
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+	preset, ok := visiblePreset(w, r, userID)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, preset)
+}
+
+// replace the name, settings and published flag of one of the caller's presets
+func handleUpdatePreset(w http.ResponseWriter, r *http.Request) {
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+	preset, ok := ownedPreset(w, r, userID)
+	if !ok {
+		return
+	}
+	req, ok := decodePresetRequest(w, r)
+	if !ok {
+		return
+	}
+
+	owned, err := presetsOwnedBy(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing presets for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error saving preset")
+		return
+	}
+	if presetNameTaken(owned, req.Name, preset.ID) {
+		writeError(w, http.StatusConflict, "name_taken", "You already have a preset with that name")
+		return
+	}
+
+	preset.Name = req.Name
+	preset.Settings = *req.Settings
+	preset.Published = req.Published
+	preset.UpdatedAt = time.Now().UTC().Truncate(time.Second)
+	err = presets.Update(r.Context(), preset)
+	if errors.Is(err, errPresetNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "No such preset")
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating preset %s: %v", preset.ID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error saving preset")
+		return
+	}
+	writeJSON(w, http.StatusOK, preset)
+}
+
+// delete one of the caller's presets, copies other users cloned from it are theirs and stay
+func handleDeletePreset(w http.ResponseWriter, r *http.Request) {
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+	preset, ok := ownedPreset(w, r, userID)
+	if !ok {
+		return
+	}
+	if _, err := presets.Delete(r.Context(), preset.ID); err != nil {
+		log.Printf("Error deleting preset %s: %v", preset.ID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error deleting preset")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// copy a published preset, or one of the caller's own, into the caller's presets
+// the body is optional, {"name": "..."} names the copy, otherwise it keeps the original name
+func handleClonePreset(w http.ResponseWriter, r *http.Request) {
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+	source, ok := visiblePreset(w, r, userID)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Request body must be empty or a JSON object with a name")
+		return
+	}
+	if req.Name == "" {
+		req.Name = source.Name
+	}
+	name, err := presetName(req.Name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_preset", err.Error())
+		return
+	}
+
+	owned, err := presetsOwnedBy(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing presets for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error cloning preset")
+		return
+	}
+	if !checkPresetRoom(w, owned, name, "") {
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	clone := &Preset{
+		OwnerID:    userID,
+		Name:       name,
+		Settings:   source.Settings,
+		ClonedFrom: source.ID,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := presets.Create(r.Context(), clone); err != nil {
+		log.Printf("Error cloning preset %s for %s: %v", source.ID, userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error cloning preset")
+		return
+	}
+
+	// only other people's clones count towards popularity, and a failed count doesn't undo the copy
+	if source.OwnerID != userID {
+		if err := presets.AddClone(r.Context(), source.ID); err != nil && !errors.Is(err, errPresetNotFound) {
+			log.Printf("Error counting clone of preset %s: %v", source.ID, err)
+		}
+	}
+	writeJSON(w, http.StatusCreated, clone)
+}
+
+// 409 if the name's taken or the caller is at the preset limit
+func checkPresetRoom(w http.ResponseWriter, owned []*Preset, name, exceptID string) bool {
+	if len(owned) >= maxPresetsPerUser {
+		writeError(w, http.StatusConflict, "preset_limit", fmt.Sprintf("You can have at most %d presets", maxPresetsPerUser))
+		return false
+	}
+	if presetNameTaken(owned, name, exceptID) {
+		writeError(w, http.StatusConflict, "name_taken", "You already have a preset with that name")
+		return false
+	}
+	return true
+}
+
+// the preset in the path if the caller may see it, unpublished presets of other users are a 404 like missing ones
+func visiblePreset(w http.ResponseWriter, r *http.Request, userID string) (*Preset, bool) {
+	preset, err := presets.Get(r.Context(), r.PathValue("id"))
+	if err == nil && !preset.Published && preset.OwnerID != userID {
+		err = errPresetNotFound
+	}
+	return presetResult(w, preset, err)
+}
+
+// the preset in the path if the caller owns it
+func ownedPreset(w http.ResponseWriter, r *http.Request, userID string) (*Preset, bool) {
+	preset, err := presets.Get(r.Context(), r.PathValue("id"))
+	if err == nil && preset.OwnerID != userID {
+		err = errPresetNotFound
+	}
+	return presetResult(w, preset, err)
+}
+
+func presetResult(w http.ResponseWriter, preset *Preset, err error) (*Preset, bool) {
+	if errors.Is(err, errPresetNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "No such preset")
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error fetching preset: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching preset")
+		return nil, false
+	}
+	return preset, true
+}
+
+// read the gallery's sort, limit and offset query parameters
+func parseGalleryQuery(query url.Values) (string, int, int, error) {
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = "popular"
+	}
+	if sortBy != "popular" && sortBy != "newest" {
+		return "", 0, 0, errors.New("sort must be popular or newest")
+	}
+
+	limit, offset := defaultGalleryPage, 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxGalleryPage {
+			return "", 0, 0, fmt.Errorf("limit must be between 1 and %d", maxGalleryPage)
+		}
+		limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return "", 0, 0, errors.New("offset must not be negative")
+		}
+		offset = n
+	}
+	return sortBy, limit, offset, nil
+}
+
+// public listing of published presets, most cloned first by default or ?sort=newest, paged like the top content routes
+func handleGallery(w http.ResponseWriter, r *http.Request) {
+	sortBy, limit, offset, err := parseGalleryQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	published, err := presets.List(r.Context(), func(p *Preset) bool { return p.Published })
+	if err != nil {
+		log.Printf("Error listing gallery: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching the gallery")
+		return
+	}
+	if published == nil {
+		published = []*Preset{}
+	}
+
+	sort.Slice(published, func(i, j int) bool {
+		a, b := published[i], published[j]
+		if sortBy == "popular" && a.Clones != b.Clones {
+			return a.Clones > b.Clones
+		}
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.After(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	})
+
+	total := len(published)
+	start, end := min(offset, total), min(offset+limit, total)
+	page := topContentResponse{
+		Items:  published[start:end],
+		Total:  total,
+		Offset: offset,
+		Limit:  limit,
+	}
+	if end < total {
+		next := end
+		page.NextOffset = &next
+		page.HasMore = true
+	}
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	writeJSON(w, http.StatusOK, page)
+}
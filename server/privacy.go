@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// PII minimization for the users table
+// the table only exists for metrics, so with PRIVACY_MODE on it keeps as little as it can: a keyed hash of the email
+// instead of the email (still enough to match waitlist entries and spot duplicates), optionally no display name, and the
+// country only as a running count in the stats table rather than against the user
+// existing rows are brought in line with `admin users migrate-pii`
+
+type privacyConfig struct {
+	enabled          bool
+	skipDisplayNames bool
+	emailHashKey     []byte
+}
+
+var privacy privacyConfig
+
+func loadPrivacyConfig() privacyConfig {
+	cfg := privacyConfig{
+		enabled:          envBool("PRIVACY_MODE", false),
+		skipDisplayNames: envBool("PRIVACY_SKIP_DISPLAY_NAMES", false),
+		emailHashKey:     []byte(envString("EMAIL_HASH_KEY", "")),
+	}
+	// without a secret key the hash of an email could be recomputed by anyone who guesses it
+	if cfg.enabled && len(cfg.emailHashKey) < 16 {
+		log.Fatal("PRIVACY_MODE needs an EMAIL_HASH_KEY of at least 16 characters")
+	}
+	return cfg
+}
+
+// keyed hash of an email, emails are lowercased first so the same address always hashes the same
+func hashEmail(email string) string {
+	mac := hmac.New(sha256.New, privacy.emailHashKey)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// what a user record compares on when matching emails, the hash whenever one can be computed so stored hashes and raw
+// emails line up
+func emailIdentity(email string) string {
+	if len(privacy.emailHashKey) > 0 {
+		return hashEmail(email)
+	}
+	return strings.ToLower(email)
+}
+
+// the email identity of a stored user, empty if there's nothing to match on
+func (u *User) emailIdentity() string {
+	if u.Email != "" {
+		return emailIdentity(u.Email)
+	}
+	return u.EmailHash
+}
+
+// turn a Spotify profile into the user record to store, dropping whatever privacy mode says not to keep
+func userFromProfile(profile *SpotifyProfile) *User {
+	user := &User{ID: profile.ID, DisplayName: profile.DisplayName, Email: profile.Email, Country: profile.Country}
+	if privacy.enabled {
+		minimizeUser(user)
+	}
+	return user
+}
+
+// strip a user down to what privacy mode keeps, the country lives on in the per-country registration counts
+func minimizeUser(user *User) {
+	if user.Email != "" {
+		user.EmailHash = hashEmail(user.Email)
+		user.Email = ""
+	}
+	if privacy.skipDisplayNames {
+		user.DisplayName = ""
+	}
+	user.Country = ""
+}
+
+// how to refer to a user in the logs, just the Spotify ID in privacy mode
+func describeProfile(profile *SpotifyProfile) string {
+	if privacy.enabled {
+		return "ID=" + profile.ID
+	}
+	return fmt.Sprintf("ID=%s, DisplayName=%s, Email=%s, Country=%s", profile.ID, profile.DisplayName, profile.Email, profile.Country)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// in-memory token bucket rate limiting, keyed by client IP or session key
+// a single EC2 instance serves everything so memory is enough, the limiter keeps no state worth sharing across restarts
+
+type rateLimiter struct {
+	name  string
+	rate  float64 // tokens added per second
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// perMinute requests on average, with bursts of up to burst requests
+// a perMinute of 0 turns the limiter off, which comes back as nil and the middleware lets everything through
+func newRateLimiter(name string, perMinute, burst int) *rateLimiter {
+	if perMinute == 0 {
+		log.Printf("Rate limiter %s is disabled", name)
+		return nil
+	}
+	if perMinute < 0 || burst < 1 {
+		log.Fatalf("Invalid %s rate limit: %d per minute with a burst of %d, both must be positive (or 0 per minute to turn it off)", name, perMinute, burst)
+	}
+	return &rateLimiter{
+		name:      name,
+		rate:      float64(perMinute) / 60,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// take a token for the key, if there isn't one return how long until there will be
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// drop buckets that have refilled completely, they're no different from a fresh one, caller holds the lock
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// answer with a standard 429 and a Retry-After in whole seconds
+func writeRateLimited(w http.ResponseWriter, limiter string, retryAfter time.Duration) {
+	rateLimited.inc(limiter)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests, please slow down")
+}
+
+// what a disabled limiter turns into
+func passThrough(next http.Handler) http.Handler { return next }
+
+// limit requests per client IP
+func limitByIP(l *rateLimiter, ips *clientIPResolver) middleware {
+	if l == nil {
+		return passThrough
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, retryAfter := l.allow(ips.clientIP(r)); !ok {
+				writeRateLimited(w, l.name, retryAfter)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limit requests per session, keyed on the raw x-token-key header so a flood is cut off before it costs a token lookup
+// requests without a key fall through to requireToken, which turns them away
+func limitBySession(l *rateLimiter) middleware {
+	if l == nil {
+		return passThrough
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key := r.Header.Get("x-token-key"); key != "" {
+				if ok, retryAfter := l.allow(key); !ok {
+					writeRateLimited(w, l.name, retryAfter)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// work out the real client IP behind NGINX and Cloudflare
+// forwarding headers are only believed when the direct peer is a trusted proxy, otherwise anyone could pick their own IP
+// CF-Connecting-IP additionally has to have come in from one of Cloudflare's addresses, anything that reaches the
+// origin some other way could set it to whatever it likes
+type clientIPResolver struct {
+	trusted    []*net.IPNet
+	cloudflare []*net.IPNet // Cloudflare's edge, empty to never believe CF-Connecting-IP
+}
+
+// defaults cover NGINX on the same host or the docker bridge
+var defaultTrustedProxies = []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
+// Cloudflare's published edge ranges, https://www.cloudflare.com/ips/
+var defaultCloudflareRanges = []string{
+	"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22", "141.101.64.0/18", "108.162.192.0/18",
+	"190.93.240.0/20", "188.114.96.0/20", "197.234.240.0/22", "198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+	"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+	"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32", "2405:8100::/32", "2a06:98c0::/29",
+	"2c0f:f248::/32",
+}
+
+func newClientIPResolver(trusted, cloudflare []string) (*clientIPResolver, error) {
+	resolver := &clientIPResolver{}
+	var err error
+	if resolver.trusted, err = parseCIDRs(trusted); err != nil {
+		return nil, err
+	}
+	if resolver.cloudflare, err = parseCIDRs(cloudflare); err != nil {
+		return nil, err
+	}
+	return resolver, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *clientIPResolver) isTrusted(ip net.IP) bool {
+	return containsIP(c.trusted, ip)
+}
+
+func (c *clientIPResolver) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil {
+		return host
+	}
+
+	// walk X-Forwarded-For from the nearest hop back, the first address that isn't one of our proxies is whoever
+	// connected to them, the client unless that's Cloudflare
+	edge := peer
+	if c.isTrusted(peer) {
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			if !c.isTrusted(ip) {
+				edge = ip
+				break
+			}
+		}
+	}
+
+	// Cloudflare puts the visitor's address in its own header, NGINX passes it along untouched
+	if containsIP(c.cloudflare, edge) {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("CF-Connecting-IP"))); ip != nil {
+			return ip.String()
+		}
+	}
+	if edge.Equal(peer) {
+		return host
+	}
+	return edge.String()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// deep readiness check, unlike /health-check this actually talks to the token and user tables and Spotify
+// results are cached for a few seconds so load balancers and the login page can't turn probes into a stream of dependency calls
+
+const readinessCheckTimeout = 3 * time.Second
+
+type dependencyStatus struct {
+	Status    string  `json:"status"` // ok or error
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type readinessReport struct {
+	Status    string                      `json:"status"` // ready or not_ready
+	CheckedAt time.Time                   `json:"checked_at"`
+	Checks    map[string]dependencyStatus `json:"checks"`
+}
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+type readinessProbe struct {
+	ttl    time.Duration
+	checks []readinessCheck
+
+	mu       sync.Mutex
+	last     *readinessReport
+	inflight chan struct{}
+}
+
+func newReadinessProbe(ttl time.Duration) *readinessProbe {
+	return &readinessProbe{
+		ttl: ttl,
+		checks: []readinessCheck{
+			{"token_store", probeTable(tableName, "TokenID")},
+			{"user_store", probeTable(usersTableName, "UserID")},
+			{"spotify_accounts", probeEndpoint("https://accounts.spotify.com/api/token")},
+			{"spotify_api", probeEndpoint("https://api.spotify.com/v1/me")},
+		},
+	}
+}
+
+// get the cached report, or run the checks if it has gone stale, concurrent callers share a single run
+func (p *readinessProbe) report(ctx context.Context) *readinessReport {
+	for {
+		p.mu.Lock()
+		if p.last != nil && time.Since(p.last.CheckedAt) < p.ttl {
+			report := p.last
+			p.mu.Unlock()
+			return report
+		}
+		if wait := p.inflight; wait != nil {
+			p.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return &readinessReport{Status: "not_ready", CheckedAt: time.Now(), Checks: map[string]dependencyStatus{}}
+			}
+		}
+		p.inflight = make(chan struct{})
+		p.mu.Unlock()
+
+		report := p.run()
+
+		p.mu.Lock()
+		p.last = report
+		close(p.inflight)
+		p.inflight = nil
+		p.mu.Unlock()
+		return report
+	}
+}
+
+// run every check in parallel, each with its own timeout, detached from any one caller's request
+func (p *readinessProbe) run() *readinessReport {
+	results := make([]dependencyStatus, len(p.checks))
+
+	var wg sync.WaitGroup
+	for i, c := range p.checks {
+		wg.Add(1)
+		go func(i int, c readinessCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), readinessCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := c.check(ctx)
+			results[i] = dependencyStatus{Status: "ok", LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				results[i].Status = "error"
+				results[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	report := &readinessReport{Status: "ready", CheckedAt: time.Now(), Checks: make(map[string]dependencyStatus)}
+	for i, c := range p.checks {
+		report.Checks[c.name] = results[i]
+		if results[i].Status != "ok" {
+			report.Status = "not_ready"
+		}
+	}
+	return report
+}
+
+// look up a key that never exists, this needs nothing beyond the GetItem permission the server already has
+func probeTable(table, keyName string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := dynamoClient.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(table),
+			Key: map[string]types.AttributeValue{
+				keyName: &types.AttributeValueMemberS{Value: "__readiness_probe__"},
+			},
+		})
+		return err
+	}
+}
+
+// any response short of a 5xx means the endpoint is reachable, unauthenticated probes get 400s and 401s back
+func probeEndpoint(endpoint string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := spotifyClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("endpoint returned %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// route reporting per-dependency readiness, 503 if anything is down so probes can act on the status alone
+func handleReady(probe *readinessProbe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := probe.report(r.Context())
+		status := http.StatusOK
+		if report.Status != "ready" {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, status, report)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+)
+
+// server side wallpaper rendering, draws the same grid the GridDisplay component does (and html2canvas downloads at 2x),
+// so a shared or fed wallpaper looks like what the user saw in the app
+// tile art comes through the shared image cache, a tile whose art can't be fetched is drawn as a placeholder rather than
+// failing the whole wallpaper
+
+const (
+	renderTilePx   = 200  // the app's 100px tiles at the download's 2x scale
+	maxRenderSide  = 4096 // longest side of a grid render, big grids get smaller tiles instead
+	renderFetchers = 8    // tile images fetched at once per render
+)
+
+// renders are CPU heavy so only a couple run at once, the rest wait their turn
+var renderSlots = make(chan struct{}, 2)
+
+var placeholderColor = color.RGBA{0x28, 0x28, 0x28, 0xff}
+
+// one piece of artwork and where it goes, an empty URL draws a placeholder
+type renderTile struct {
+	Rect     image.Rectangle
+	ImageURL string
+}
+
+// everything needed to draw a wallpaper, the layout is worked out before rendering so other layouts can reuse the drawing
+type wallpaper struct {
+	Width, Height int
+	UseGradient   bool   // otherwise the background is transparent, like the app's download
+	Color1        string // #rrggbb
+	Color2        string
+	Radius        int // corner radius of the whole wallpaper, 0 for square corners
+	Tiles         []renderTile
+	TileRadius    int // corner radius of each tile
+	Profile       *renderTile
+	ProfileRing   int // width of the gradient ring around the profile picture
+}
+
+// lay out a plain grid, cols x rows tiles with the app's gap and padding scaled to the tile size
+// urls fill the grid row by row, or the mosaic by rank, any tiles past the end of urls are left empty
+func gridWallpaper(settings *Preferences, urls []string, profileURL string) *wallpaper {
+	cols, rows := settings.GridSize.X, settings.GridSize.Y
+	tile := renderTilePx
+	// 10px gap and padding around 100px tiles, so a tenth of a tile each, and 1.1 tiles per column or row all in
+	if longest := max(cols, rows); longest*tile*11/10+tile/10 > maxRenderSide {
+		tile = max(minImageWidth, maxRenderSide*10/(longest*11+1))
+	}
+	gap := max(1, tile/10)
+
+	wp := &wallpaper{
+		Width:       cols*tile + (cols+1)*gap,
+		Height:      rows*tile + (rows+1)*gap,
+		UseGradient: settings.UseGradient,
+		Color1:      settings.Color1,
+		Color2:      settings.Color2,
+		Radius:      2 * gap,
+		TileRadius:  tile * 8 / 100,
+	}
+	for _, mt := range layoutTiles(settings, cols, rows, 1) {
+		// a bigger mosaic tile swallows the gaps it spans so its edges line up with the tiles around it
+		x, y := gap+mt.X*(tile+gap), gap+mt.Y*(tile+gap)
+		side := mt.Size*tile + (mt.Size-1)*gap
+		t := renderTile{Rect: image.Rect(x, y, x+side, y+side)}
+		if mt.Rank <= len(urls) {
+			t.ImageURL = urls[mt.Rank-1]
+		}
+		wp.Tiles = append(wp.Tiles, t)
+	}
+
+	// the app overlays a 175px circle in the middle of the grid, 1.75 tiles across
+	if settings.IncludeProfilePicture && profileURL != "" {
+		size := min(tile*175/100, wp.Width-2*gap, wp.Height-2*gap)
+		x, y := (wp.Width-size)/2, (wp.Height-size)/2
+		wp.Profile = &renderTile{Rect: image.Rect(x, y, x+size, y+size), ImageURL: profileURL}
+		wp.ProfileRing = max(1, size*13/175)
+	}
+	return wp
+}
+
+// draw a wallpaper, tile art is fetched through the image cache in parallel
+func renderWallpaper(ctx context.Context, wp *wallpaper) (*image.RGBA, error) {
+	select {
+	case renderSlots <- struct{}{}:
+		defer func() { <-renderSlots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, wp.Width, wp.Height))
+	background := image.NewRGBA(canvas.Bounds())
+	if wp.UseGradient {
+		fillGradient(background, parseHexColor(wp.Color1), parseHexColor(wp.Color2))
+	}
+	draw.DrawMask(canvas, canvas.Bounds(), background, image.Point{}, roundedMask(canvas.Bounds(), wp.Radius), image.Point{}, draw.Over)
+
+	art := make([]image.Image, len(wp.Tiles))
+	sem := make(chan struct{}, renderFetchers)
+	var wg sync.WaitGroup
+	for i, t := range wp.Tiles {
+		if t.ImageURL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, t renderTile) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			art[i] = fetchTileArt(ctx, t)
+		}(i, t)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, t := range wp.Tiles {
+		drawTile(canvas, t.Rect, art[i], wp.TileRadius)
+	}
+
+	if wp.Profile != nil {
+		ring := wp.Profile.Rect
+		if wp.UseGradient {
+			draw.DrawMask(canvas, ring, background, ring.Min, roundedMask(ring, ring.Dx()/2), ring.Min, draw.Over)
+		}
+		inner := ring.Inset(wp.ProfileRing)
+		if picture := fetchTileArt(ctx, renderTile{Rect: inner, ImageURL: wp.Profile.ImageURL}); picture != nil {
+			drawTile(canvas, inner, picture, inner.Dx()/2)
+		}
+	}
+	return canvas, nil
+}
+
+// fetch and fit the art for a tile, nil if it can't be had
+func fetchTileArt(ctx context.Context, t renderTile) image.Image {
+	width := min(max(t.Rect.Dx(), minImageWidth), maxImageWidth)
+	src, err := imgCache.FetchImage(ctx, t.ImageURL, width)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Error fetching tile image %s: %v", t.ImageURL, err)
+		}
+		return nil
+	}
+	return coverImage(src, t.Rect.Dx(), t.Rect.Dy())
+}
+
+// crop the middle of an image to the target's aspect ratio and scale it to fill, like object-fit: cover
+func coverImage(src image.Image, w, h int) image.Image {
+	b := src.Bounds()
+	cw, ch := b.Dx(), b.Dx()*h/w
+	if ch > b.Dy() {
+		cw, ch = b.Dy()*w/h, b.Dy()
+	}
+	x, y := b.Min.X+(b.Dx()-cw)/2, b.Min.Y+(b.Dy()-ch)/2
+	cropped := image.NewRGBA(image.Rect(0, 0, cw, ch))
+	draw.Draw(cropped, cropped.Bounds(), src, image.Pt(x, y), draw.Src)
+	return scaleImage(cropped, w, h)
+}
+
+// draw a tile's art, or a placeholder if there isn't any, clipped to rounded corners
+func drawTile(canvas *image.RGBA, rect image.Rectangle, art image.Image, radius int) {
+	var src image.Image = image.NewUniform(placeholderColor)
+	srcPt := image.Point{}
+	if art != nil {
+		src, srcPt = art, art.Bounds().Min
+	}
+	draw.DrawMask(canvas, rect, src, srcPt, roundedMask(rect, radius), rect.Min, draw.Over)
+}
+
+// CSS "linear-gradient(to bottom right, c1, c2)", the gradient line runs so that the top right and bottom left corners
+// share a color, which makes it perpendicular to that diagonal rather than along the top left to bottom right one
+func fillGradient(img *image.RGBA, c1, c2 color.RGBA) {
+	b := img.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			t := (float64(x)*h + float64(y)*w) / (2 * w * h)
+			img.SetRGBA(b.Min.X+x, b.Min.Y+y, color.RGBA{
+				R: lerp(c1.R, c2.R, t),
+				G: lerp(c1.G, c2.G, t),
+				B: lerp(c1.B, c2.B, t),
+				A: 0xff,
+			})
+		}
+	}
+}
+
+func lerp(a, b uint8, t float64) uint8 {
+	return uint8(float64(a) + (float64(b)-float64(a))*t + 0.5)
+}
+
+// #rrggbb to a color, the value has already been validated so anything else comes out black
+func parseHexColor(s string) color.RGBA {
+	n, err := strconv.ParseUint(s[min(1, len(s)):], 16, 32)
+	if err != nil || len(s) != 7 {
+		return color.RGBA{A: 0xff}
+	}
+	return color.RGBA{R: uint8(n >> 16), G: uint8(n >> 8), B: uint8(n), A: 0xff}
+}
+
+// alpha mask for a rectangle with rounded corners, anti-aliased by coverage of each corner pixel
+type rounded struct {
+	rect   image.Rectangle
+	radius int
+}
+
+func roundedMask(rect image.Rectangle, radius int) image.Image {
+	if radius <= 0 {
+		return nil // DrawMask treats a nil mask as fully opaque
+	}
+	return &rounded{rect: rect, radius: min(radius, rect.Dx()/2, rect.Dy()/2)}
+}
+
+func (m *rounded) ColorModel() color.Model { return color.AlphaModel }
+func (m *rounded) Bounds() image.Rectangle { return m.rect }
+
+func (m *rounded) At(x, y int) color.Color {
+	r := float64(m.radius)
+	// distance into the corner square, zero everywhere outside the corners
+	cx := max(float64(m.rect.Min.X)+r-float64(x)-0.5, float64(x)+0.5-(float64(m.rect.Max.X)-r), 0)
+	cy := max(float64(m.rect.Min.Y)+r-float64(y)-0.5, float64(y)+0.5-(float64(m.rect.Max.Y)-r), 0)
+	if cx == 0 || cy == 0 {
+		return color.Opaque
+	}
+	d := r - math.Hypot(cx, cy)
+	switch {
+	case d >= 0.5:
+		return color.Opaque
+	case d <= -0.5:
+		return color.Transparent
+	}
+	return color.Alpha{A: uint8((d + 0.5) * 255)}
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("error encoding png: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// small in-memory LRU of rendered PNGs, rendering the same wallpaper again is far more work than keeping the bytes
+type renderCache struct {
+	mu      sync.Mutex
+	max     int
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type renderCacheEntry struct {
+	key  string
+	data []byte
+}
+
+func newRenderCache(max int) *renderCache {
+	return &renderCache{max: max, lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *renderCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*renderCacheEntry).data, true
+	}
+	return nil, false
+}
+
+func (c *renderCache) Add(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*renderCacheEntry).data = data
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&renderCacheEntry{key: key, data: data})
+	for c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*renderCacheEntry).key)
+	}
+}
+
+func (c *renderCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// all current routes live under this prefix, the bare paths the frontend used originally are kept as deprecated aliases
+const apiPrefix = "/api/v1"
+
+type middleware func(http.Handler) http.Handler
+
+// wrap a handler in middleware, the first middleware listed is the outermost
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// small method-aware router on top of http.ServeMux
+// the mux only matches paths (so {wildcards} and r.PathValue still work), the method table behind each path is ours,
+// that way unmatched paths and methods get JSON 404s and 405s instead of the mux's plain text ones
+type router struct {
+	mux     *http.ServeMux
+	routes  map[string]map[string]http.Handler // path pattern -> method -> handler
+	handler http.Handler
+}
+
+// create a router, the middleware runs on every request including ones that end up as 404s and 405s
+func newRouter(mws ...middleware) *router {
+	rt := &router{
+		mux:    http.NewServeMux(),
+		routes: make(map[string]map[string]http.Handler),
+	}
+	rt.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "not_found", "Wallify Server: Page not found")
+	})
+	rt.handler = chain(rt.mux, mws...)
+	return rt
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.handler.ServeHTTP(w, r)
+}
+
+// register a handler for a method and path, wrapped in any route specific middleware (i.e. auth)
+func (rt *router) handle(method, path string, h http.Handler, mws ...middleware) {
+	methods, ok := rt.routes[path]
+	if !ok {
+		methods = make(map[string]http.Handler)
+		rt.routes[path] = methods
+		rt.mux.Handle(path, rt.dispatch(methods))
+	}
+	if _, exists := methods[method]; exists {
+		panic("router: duplicate route " + method + " " + path)
+	}
+	methods[method] = chain(h, mws...)
+}
+
+// register an old unversioned path as an alias for a versioned route
+// responses carry Deprecation and Link headers pointing clients at the replacement
+func (rt *router) deprecated(method, path, successor string) {
+	h, ok := rt.routes[successor][method]
+	if !ok {
+		panic("router: deprecated alias for unknown route " + method + " " + successor)
+	}
+	rt.handle(method, path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		h.ServeHTTP(w, r)
+	}))
+}
+
+// pick the handler for the request method, HEAD falls back to GET like the standard mux does
+func (rt *router) dispatch(methods map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, ok := methods[r.Method]
+		if !ok && r.Method == http.MethodHead {
+			h, ok = methods[http.MethodGet]
+		}
+		if ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Allow", allowedMethods(methods))
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" is not allowed on "+r.URL.Path)
+	})
+}
+
+func allowedMethods(methods map[string]http.Handler) string {
+	allowed := []string{http.MethodOptions}
+	for method := range methods {
+		allowed = append(allowed, method)
+		if method == http.MethodGet {
+			allowed = append(allowed, http.MethodHead)
+		}
+	}
+	sort.Strings(allowed)
+	return strings.Join(allowed, ", ")
+}
+
+// error body shared by every JSON error response
+type errorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, errorResponse{Error: code, Message: message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
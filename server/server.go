@@ -13,14 +13,20 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 )
@@ -32,22 +38,203 @@ var (
 	dynamoClient *dynamodb.Client
 )
 
-var tableName = "Wallify-Tokens"
+var (
+	tableName         = "Wallify-Tokens"
+	usersTableName    = "Wallify-Users"
+	waitlistTableName = "Wallify-Waitlist"
+	auditTableName    = "Wallify-Audit"
+	statsTableName    = "Wallify-Stats"
+	presetsTableName  = "Wallify-Presets"
+	sharesTableName   = "Wallify-Shares"
+	feedsTableName    = "Wallify-Feeds"
+)
 
 // healthCheck is a simple route to check if the server is running
 func healthCheck(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, "Server is up")
 }
 
+// rate limiters shared by the routes, along with the resolver that finds the client IP behind the proxies
+type rateLimits struct {
+	ip, auth, session *rateLimiter
+	ips               *clientIPResolver
+}
+
+func loadRateLimits() rateLimits {
+	var cloudflare []string
+	if envBool("TRUST_CF_CONNECTING_IP", true) {
+		cloudflare = envList("CLOUDFLARE_RANGES", defaultCloudflareRanges)
+	}
+	ips, err := newClientIPResolver(envList("TRUSTED_PROXIES", defaultTrustedProxies), cloudflare)
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES or CLOUDFLARE_RANGES: %v", err)
+	}
+	return rateLimits{
+		// a grid pulls up to 99 images through /img, so the general budget allows for that burst
+		ip:      newRateLimiter("ip", envInt("RATE_LIMIT_IP_PER_MIN", 300), envInt("RATE_LIMIT_IP_BURST", 150)),
+		auth:    newRateLimiter("auth", envInt("RATE_LIMIT_AUTH_PER_MIN", 10), envInt("RATE_LIMIT_AUTH_BURST", 5)),
+		session: newRateLimiter("session", envInt("RATE_LIMIT_SESSION_PER_MIN", 30), envInt("RATE_LIMIT_SESSION_BURST", 15)),
+		ips:     ips,
+	}
+}
+
+// route table, every route is versioned under /api/v1 and keeps its original bare path as a deprecated alias
+// requests that don't match a path or method get JSON 404s and 405s from the router
+func newAPIRouter(cors corsConfig, limits rateLimits, metricsToken, adminToken string) *router {
+	rt := newRouter(withMetrics, withLogging, withRecovery, withCors(cors))
+
+	// separate budgets, per IP for everything, a tighter per IP one for the login flow, and per session for Spotify backed routes
+	byIP := limitByIP(limits.ip, limits.ips)
+	auth := []middleware{limitByIP(limits.auth, limits.ips)}
+	authed := []middleware{byIP, limitBySession(limits.session), requireToken}
+
+	routes := []struct {
+		method  string
+		path    string
+		handler http.HandlerFunc
+		mws     []middleware
+	}{
+		// login route, redirects the user to the Spotify login page
+		{"GET", "/login", handleLogin, auth},
+		// callback route, it's a bit more complicated so details are abstracted to the handleCallback function
+		{"GET", "/callback", handleCallback, auth},
+		// health check route, allows the client to check if the server is running before redirecting to the login route
+		{"GET", "/health-check", healthCheck, nil},
+		// routes to get the top artists, top tracks, and profile picture for the user
+		{"GET", "/top-artists", handleTopContent("artists"), authed},
+		{"GET", "/top-tracks", handleTopContent("tracks"), authed},
+		{"GET", "/profile", handleProfile, authed},
+		// ends the session, the token key stops working immediately
+		{"POST", "/logout", handleLogout, authed},
+		// same-origin proxy for Spotify CDN images, backed by the on-disk cache
+		{"GET", "/img", handleImageProxy, []middleware{byIP}},
+	}
+
+	for _, route := range routes {
+		rt.handle(route.method, apiPrefix+route.path, route.handler, route.mws...)
+		rt.deprecated(route.method, route.path, apiPrefix+route.path)
+	}
+
+	// the caller's own data, everything stored about them and a way to delete all of it
+	rt.handle("GET", apiPrefix+"/me/data", http.HandlerFunc(handleMyData), authed...)
+	rt.handle("DELETE", apiPrefix+"/me", http.HandlerFunc(handleDeleteMe), authed...)
+
+	// saved Options panel settings
+	rt.handle("GET", apiPrefix+"/preferences", http.HandlerFunc(handleGetPreferences), authed...)
+	rt.handle("PUT", apiPrefix+"/preferences", http.HandlerFunc(handlePutPreferences), authed...)
+
+	// named layout presets, and the public gallery of the published ones which needs no login
+	// the device resolution presets and the grid planned for them are public too
+	rt.handle("GET", apiPrefix+"/presets/devices", http.HandlerFunc(handleListDevices), byIP)
+	rt.handle("GET", apiPrefix+"/presets/devices/{id}/plan", http.HandlerFunc(handlePlanDevice), byIP)
+	rt.handle("GET", apiPrefix+"/presets", http.HandlerFunc(handleListPresets), authed...)
+	rt.handle("POST", apiPrefix+"/presets", http.HandlerFunc(handleCreatePreset), authed...)
+	rt.handle("GET", apiPrefix+"/presets/{id}", http.HandlerFunc(handleGetPreset), authed...)
+	rt.handle("PUT", apiPrefix+"/presets/{id}", http.HandlerFunc(handleUpdatePreset), authed...)
+	rt.handle("DELETE", apiPrefix+"/presets/{id}", http.HandlerFunc(handleDeletePreset), authed...)
+	rt.handle("POST", apiPrefix+"/presets/{id}/clone", http.HandlerFunc(handleClonePreset), authed...)
+	rt.handle("GET", apiPrefix+"/gallery", http.HandlerFunc(handleGallery), byIP)
+
+	// shareable wallpaper snapshots, the /w links are what gets pasted around so they're short and outside /api/v1
+	rt.handle("GET", apiPrefix+"/shares", http.HandlerFunc(handleListShares), authed...)
+	rt.handle("POST", apiPrefix+"/shares", http.HandlerFunc(handleCreateShare), authed...)
+	rt.handle("DELETE", apiPrefix+"/shares/{id}", http.HandlerFunc(handleDeleteShare), authed...)
+	rt.handle("GET", "/w/{id}", http.HandlerFunc(handleShareLink), byIP)
+
+	// per-device wallpaper feeds, the feed url carries its own secret so it needs no session
+	rt.handle("GET", apiPrefix+"/feeds", http.HandlerFunc(handleListFeeds), authed...)
+	rt.handle("POST", apiPrefix+"/feeds", http.HandlerFunc(handleCreateFeed), authed...)
+	rt.handle("POST", apiPrefix+"/feeds/{id}/rotate", http.HandlerFunc(handleRotateFeed), authed...)
+	rt.handle("DELETE", apiPrefix+"/feeds/{id}", http.HandlerFunc(handleRevokeFeed), authed...)
+	rt.handle("GET", "/feed/{file}", http.HandlerFunc(handleFeed), byIP)
+
+	// access waitlist, asking shares the login flow's tighter budget, the rest is admin only
+	// these are new so they only exist under /api/v1
+	admin := []middleware{byIP, requireAdminToken(adminToken)}
+	rt.handle("POST", apiPrefix+"/waitlist", http.HandlerFunc(handleWaitlistJoin), auth...)
+	rt.handle("GET", apiPrefix+"/admin/waitlist", http.HandlerFunc(handleWaitlistList), admin...)
+	rt.handle("GET", apiPrefix+"/admin/waitlist/export", http.HandlerFunc(handleWaitlistExport), admin...)
+	rt.handle("POST", apiPrefix+"/admin/waitlist/{email}/approve", http.HandlerFunc(handleWaitlistApprove), admin...)
+	rt.handle("POST", apiPrefix+"/admin/waitlist/{email}/reject", http.HandlerFunc(handleWaitlistReject), admin...)
+
+	// usage stats from the running counters
+	rt.handle("GET", apiPrefix+"/admin/stats", http.HandlerFunc(handleAdminStats), admin...)
+
+	// revoking through the server drops its cached copy of the session too, see the admin commands
+	rt.handle("DELETE", apiPrefix+"/admin/sessions/{key}", http.HandlerFunc(handleAdminRevokeSession), admin...)
+
+	// deep readiness probe, checks the token and user tables and Spotify rather than just answering
+	// served both versioned for the frontend and bare for infrastructure probes
+	probe := newReadinessProbe(envDuration("READY_CACHE_TTL", 10*time.Second))
+	rt.handle("GET", apiPrefix+"/ready", handleReady(probe))
+	rt.handle("GET", "/ready", handleReady(probe))
+
+	// Prometheus scrape endpoint, unversioned since it's for infrastructure rather than the frontend
+	rt.handle("GET", "/metrics", http.HandlerFunc(handleMetrics), requireMetricsToken(metricsToken))
+
+	return rt
+}
+
+// connect to DynamoDB and set up the token, user and waitlist stores, shared by the server and the admin commands
+// DYNAMO_ENDPOINT points everything somewhere else, i.e. DynamoDB Local at http://localhost:8000, and the table names can
+// be overridden for a separate set of tables
+func openStores(ctx context.Context) {
+	tableName = envString("TOKENS_TABLE", tableName)
+	usersTableName = envString("USERS_TABLE", usersTableName)
+	waitlistTableName = envString("WAITLIST_TABLE", waitlistTableName)
+	auditTableName = envString("AUDIT_TABLE", auditTableName)
+	statsTableName = envString("STATS_TABLE", statsTableName)
+	presetsTableName = envString("PRESETS_TABLE", presetsTableName)
+	sharesTableName = envString("SHARES_TABLE", sharesTableName)
+	feedsTableName = envString("FEEDS_TABLE", feedsTableName)
+	privacy = loadPrivacyConfig()
+
+	// load the AWS SDK config to connect to DynamoDB
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(envString("AWS_REGION", "us-east-1")),
+	)
+	if err != nil {
+		log.Fatalf("Error loading AWS SDK config: %v", err)
+	}
+
+	// every DynamoDB call goes through the metrics middleware
+	endpoint := os.Getenv("DYNAMO_ENDPOINT")
+	dynamoClient = dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		o.APIOptions = append(o.APIOptions, withDynamoMetrics)
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+
+	tokens = &dynamoTokenStore{client: dynamoClient, table: tableName}
+	users = &dynamoUserStore{client: dynamoClient, table: usersTableName}
+	waitlist = &waitlistStore{client: dynamoClient, table: waitlistTableName}
+	audit = &auditStore{client: dynamoClient, table: auditTableName}
+	stats = &statsStore{client: dynamoClient, table: statsTableName}
+	presets = &presetStore{client: dynamoClient, table: presetsTableName}
+	shares = &shareStore{client: dynamoClient, table: sharesTableName}
+	feeds = &feedStore{client: dynamoClient, table: feedsTableName}
+	devModeUserLimit = envInt("DEV_MODE_USER_LIMIT", devModeUserLimit)
+}
+
 func main() {
+	// `wallify admin ...` runs a maintenance command instead of the server, see admincli.go
+	// the .env file is optional there since the settings can just as well come from the shell
+	adminMode := len(os.Args) > 1 && os.Args[1] == "admin"
+
 	// load environment variables
 	err := godotenv.Load(".env")
-	if err != nil {
+	if err != nil && !adminMode {
 		log.Fatalf("Error loading .env file")
 	}
 
+	if adminMode {
+		openStores(context.Background())
+		tokens = revokeThroughServer(tokens, os.Getenv("ADMIN_SERVER_URL"), os.Getenv("ADMIN_TOKEN"))
+		os.Exit(runAdmin(os.Args[2:], os.Stdout))
+	}
+
 	clientId = os.Getenv("CLIENT_ID")
 	clientSecret = os.Getenv("CLIENT_SECRET")
 	redirectUri = os.Getenv("REDIRECT_URI")
@@ -57,44 +244,58 @@ func main() {
 		log.Fatal("Missing environment variables: CLIENT_ID, CLIENT_SECRET, or REDIRECT_URI")
 	}
 
-	// load the AWS SDK config to connect to DynamoDB
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion("us-east-1"),
-	)
-	if err != nil {
-		log.Fatalf("Error loading AWS SDK config: %v", err)
-	}
-
-	dynamoClient = dynamodb.NewFromConfig(cfg)
+	openStores(context.Background())
 
-	// basic catch all route, make sure the server is running
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "Wallify Server: Page not found")
-	})
+	// token lookups go through a short-lived in-process cache, writes through it invalidate immediately
+	tokens = newCachedTokenStore(tokens, envDuration("TOKEN_CACHE_TTL", 30*time.Second), envInt("TOKEN_CACHE_SIZE", 1000))
 
-	// login route, basically uses the Spotify API to generate an auth URL and redirects the user to the Spotify login page
-	http.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
-		enableCors(&w)
+	// set up the on-disk image cache shared by the image proxy, defaults to 256MB under the temp directory
+	cacheDir := envString("IMAGE_CACHE_DIR", filepath.Join(os.TempDir(), "wallify-images"))
+	cacheMB := envInt("IMAGE_CACHE_MAX_MB", 256)
+	if cacheMB < 1 {
+		log.Fatalf("Invalid IMAGE_CACHE_MAX_MB: %d", cacheMB)
+	}
+	imgCache, err = newImageCache(cacheDir, int64(cacheMB)<<20)
+	if err != nil {
+		log.Fatalf("Error setting up image cache: %v", err)
+	}
 
-		authUrl := fmt.Sprintf(
-			"https://accounts.spotify.com/authorize?client_id=%s&response_type=code&redirect_uri=%s&scope=user-top-read user-read-email user-read-private",
-			clientId, url.QueryEscape(redirectUri))
+	// share links are built on the server's public address
+	publicURL = strings.TrimSuffix(envString("PUBLIC_URL", publicURL), "/")
+	feedContentTTL = envDuration("FEED_CONTENT_TTL", feedContentTTL)
 
-		log.Println("Generated Authorization URL:", authUrl)
-		http.Redirect(w, r, authUrl, http.StatusSeeOther)
-	})
+	// explicit server so slow clients can't hold connections open forever, write timeout leaves room for the Spotify calls
+	server := &http.Server{
+		Addr:              envString("LISTEN_ADDR", ":8888"),
+		Handler:           newAPIRouter(loadCorsConfig(), loadRateLimits(), os.Getenv("METRICS_TOKEN"), os.Getenv("ADMIN_TOKEN")),
+		ReadHeaderTimeout: envDuration("READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       envDuration("READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:      envDuration("WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:       envDuration("IDLE_TIMEOUT", 120*time.Second),
+	}
+	shutdownTimeout := envDuration("SHUTDOWN_TIMEOUT", 20*time.Second)
 
-	// callback route, it's a bit more complicated so details are abstracted to the handleCallback function
-	http.HandleFunc("/callback", handleCallback)
+	// docker stop sends SIGTERM, ctrl+c sends SIGINT, either one starts a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	// health check route, allows the client to check if the server is running before redirecting to the login route
-	http.HandleFunc("/health-check", healthCheck)
+	go func() {
+		log.Printf("Server is running on http://18.215.27.1%s", server.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server error: %v", err)
+		}
+	}()
 
-	// routes to get the top artists, top tracks, and profile picture for the user
-	http.HandleFunc("/top-artists", handleTopContent("artists"))
-	http.HandleFunc("/top-tracks", handleTopContent("tracks"))
-	http.HandleFunc("/profile", handleProfile)
+	<-ctx.Done()
+	stop() // a second signal kills the process straight away
 
-	log.Println("Server is running on http://18.215.27.1:8888")
-	log.Fatal(http.ListenAndServe(":8888", nil))
+	// stop accepting connections and let in-flight requests finish, anything still running at the deadline is cut off
+	log.Printf("Shutting down, draining in-flight requests for up to %v", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Graceful shutdown did not finish: %v", err)
+		server.Close()
+	}
+	log.Println("Server stopped")
 }
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// shareable wallpaper permalinks
+// a share freezes the user's top items and layout at the moment it's made, so the link keeps showing the same wallpaper
+// however their listening changes, /w/{id} serves the rendered PNG, or to browsers and link unfurlers an HTML page with
+// Open Graph and Twitter card tags pointing at the PNG
+
+const maxSharesPerUser = 50
+
+var errShareNotFound = errors.New("share not found")
+
+// where the server is reachable from outside, share links and their preview images are built on it
+var publicURL = "https://wallify-server.doypid.com"
+
+// rendered share PNGs, a share never changes so a render stays good until the share is deleted
+var shareRenders = newRenderCache(64)
+
+type shareItem struct {
+	Rank     int    `json:"rank"`
+	Name     string `json:"name"`
+	Artists  string `json:"artists,omitempty"` // tracks only
+	ImageURL string `json:"imageUrl,omitempty"`
+}
+
+type Share struct {
+	ID                string      `json:"id"`
+	OwnerID           string      `json:"-"`
+	URL               string      `json:"url"` // filled in when sent out, not stored
+	ContentType       string      `json:"contentType"`
+	Settings          Preferences `json:"settings"`
+	Items             []shareItem `json:"items"`
+	ProfilePictureURL string      `json:"profilePictureUrl,omitempty"`
+	CreatedAt         time.Time   `json:"createdAt"`
+}
+
+// the frozen part of a share, kept as one JSON document on the row
+type shareSnapshot struct {
+	ContentType       string      `json:"contentType"`
+	Settings          Preferences `json:"settings"`
+	Items             []shareItem `json:"items"`
+	ProfilePictureURL string      `json:"profilePictureUrl,omitempty"`
+}
+
+// shares live in their own table keyed by the short ID in the link, with the owner's Spotify ID on each row
+type shareStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+var shares *shareStore
+
+// store a new share under a fresh ID, the ID is filled in on the share
+func (s *shareStore) Create(ctx context.Context, share *Share) error {
+	doc, err := json.Marshal(shareSnapshot{
+		ContentType:       share.ContentType,
+		Settings:          share.Settings,
+		Items:             share.Items,
+		ProfilePictureURL: share.ProfilePictureURL,
+	})
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		id, err := newShortID()
+		if err != nil {
+			return err
+		}
+		_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(s.table),
+			Item: map[string]types.AttributeValue{
+				"ShareID":   &types.AttributeValueMemberS{Value: id},
+				"OwnerID":   &types.AttributeValueMemberS{Value: share.OwnerID},
+				"Snapshot":  &types.AttributeValueMemberS{Value: string(doc)},
+				"CreatedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(share.CreatedAt.Unix(), 10)},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(ShareID)"),
+		})
+		var taken *types.ConditionalCheckFailedException
+		if errors.As(err, &taken) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error creating share: %w", err)
+		}
+		share.ID = id
+		return nil
+	}
+	return errors.New("error creating share: no free id")
+}
+
+// a single share, errShareNotFound if there's no such ID
+func (s *shareStore) Get(ctx context.Context, id string) (*Share, error) {
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"ShareID": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching share: %w", err)
+	}
+	if result.Item == nil {
+		return nil, errShareNotFound
+	}
+	return shareFromItem(result.Item)
+}
+
+// remove a share, returns false if there wasn't one
+func (s *shareStore) Delete(ctx context.Context, id string) (bool, error) {
+	result, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"ShareID": &types.AttributeValueMemberS{Value: id},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return false, fmt.Errorf("error deleting share: %w", err)
+	}
+	shareRenders.Remove(id)
+	return result.Attributes != nil, nil
+}
+
+// a user's shares, newest first, the table stays small enough that a scan is fine
+func (s *shareStore) ListOwnedBy(ctx context.Context, userID string) ([]*Share, error) {
+	owned := []*Share{}
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{TableName: aws.String(s.table)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning shares: %w", err)
+		}
+		for _, item := range page.Items {
+			if v, ok := item["OwnerID"].(*types.AttributeValueMemberS); !ok || v.Value != userID {
+				continue
+			}
+			share, err := shareFromItem(item)
+			if err != nil {
+				log.Printf("Skipping unreadable share: %v", err)
+				continue
+			}
+			owned = append(owned, share)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool { return owned[i].CreatedAt.After(owned[j].CreatedAt) })
+	return owned, nil
+}
+
+func shareFromItem(item map[string]types.AttributeValue) (*Share, error) {
+	share := &Share{}
+	if v, ok := item["ShareID"].(*types.AttributeValueMemberS); ok {
+		share.ID = v.Value
+	}
+	if v, ok := item["OwnerID"].(*types.AttributeValueMemberS); ok {
+		share.OwnerID = v.Value
+	}
+	if v, ok := item["CreatedAt"].(*types.AttributeValueMemberN); ok {
+		seconds, _ := strconv.ParseInt(v.Value, 10, 64)
+		share.CreatedAt = time.Unix(seconds, 0).UTC()
+	}
+	if v, ok := item["Snapshot"].(*types.AttributeValueMemberS); ok {
+		var snapshot shareSnapshot
+		if err := json.Unmarshal([]byte(v.Value), &snapshot); err != nil {
+			return nil, fmt.Errorf("share %s: error parsing snapshot: %w", share.ID, err)
+		}
+		share.ContentType = snapshot.ContentType
+		share.Settings = snapshot.Settings
+		share.Items = snapshot.Items
+		share.ProfilePictureURL = snapshot.ProfilePictureURL
+	}
+	share.URL = shareURL(share.ID)
+	return share, nil
+}
+
+func shareURL(id string) string {
+	return publicURL + "/w/" + id
+}
+
+// the layout for a new share, given outright, taken from a preset, or else the caller's saved preferences
+type shareRequest struct {
+	Settings *Preferences `json:"settings"`
+	PresetID string       `json:"presetId"`
+}
+
+func shareSettings(ctx context.Context, req *shareRequest, userID string) (*Preferences, error) {
+	if req.Settings != nil {
+		req.Settings.UpdatedAt = nil
+		return req.Settings, req.Settings.validate()
+	}
+	if req.PresetID != "" {
+		preset, err := presets.Get(ctx, req.PresetID)
+		if err == nil && !preset.Published && preset.OwnerID != userID {
+			err = errPresetNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &preset.Settings, nil
+	}
+	prefs, err := users.GetPreferences(ctx, userID)
+	if err != nil && !errors.Is(err, errUserNotFound) {
+		return nil, err
+	}
+	if prefs == nil {
+		prefs = defaultPreferences()
+	}
+	prefs.UpdatedAt = nil
+	return prefs, nil
+}
+
+// freeze the caller's current top items into a new share
+// the body is optional, {"settings": {...}} or {"presetId": "..."} picks the layout, otherwise the saved preferences are used
+func handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	token := tokenFromContext(r.Context())
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+
+	req := &shareRequest{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Request body must be empty or a JSON object with settings or a presetId")
+		return
+	}
+	settings, err := shareSettings(r.Context(), req, userID)
+	if errors.Is(err, errPresetNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "No such preset")
+		return
+	}
+	if err != nil && req.Settings != nil {
+		writeError(w, http.StatusBadRequest, "invalid_preferences", err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading share settings for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error creating share")
+		return
+	}
+
+	owned, err := shares.ListOwnedBy(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing shares for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error creating share")
+		return
+	}
+	if len(owned) >= maxSharesPerUser {
+		writeError(w, http.StatusConflict, "share_limit", fmt.Sprintf("You can have at most %d shares, delete one first", maxSharesPerUser))
+		return
+	}
+
+	items, err := snapshotTopItems(r.Context(), token, settings)
+	if err != nil {
+		log.Printf("Error fetching top %s for share: %v", settings.SelectionType, err)
+		writeSpotifyError(w, err, fmt.Sprintf("Error fetching top %s", settings.SelectionType))
+		return
+	}
+	// the color order and picked background are frozen into the share along with the items
+	urls := make([]string, len(items))
+	for i, item := range items {
+		urls[i] = item.ImageURL
+	}
+	order, settings := paletteLayout(r.Context(), urls, settings)
+	share := &Share{
+		OwnerID:     userID,
+		ContentType: settings.SelectionType,
+		Settings:    *settings,
+		Items:       make([]shareItem, 0, len(items)),
+		CreatedAt:   time.Now().UTC().Truncate(time.Second),
+	}
+	for _, i := range order {
+		share.Items = append(share.Items, items[i])
+	}
+	if settings.IncludeProfilePicture {
+		picture, err := fetchProfilePicture(r.Context(), token, renderTilePx*2)
+		if err != nil {
+			log.Printf("Error fetching profile picture for share: %v", err)
+			writeSpotifyError(w, err, "Error fetching profile")
+			return
+		}
+		if picture != nil {
+			share.ProfilePictureURL = picture.URL
+		}
+	}
+
+	if err := shares.Create(r.Context(), share); err != nil {
+		log.Printf("Error creating share for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error creating share")
+		return
+	}
+	share.URL = shareURL(share.ID)
+	writeJSON(w, http.StatusCreated, share)
+}
+
+// the caller's top items as the grid would show them, only as many as fit and skipping art-less ones if asked to
+func snapshotTopItems(ctx context.Context, token *Token, settings *Preferences) ([]shareItem, error) {
+	fit := settings.GridSize.X * settings.GridSize.Y
+	limit := fit
+	if settings.ExcludeNullImages {
+		limit = maxTopContent // some will be dropped, so fetch enough to still fill the grid
+	}
+	raw, _, err := getTopContent(ctx, token.AccessToken, token.TokenID, settings.SelectionType, limit, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []shareItem{}
+	for _, item := range compactContent(raw, 0, renderTilePx) {
+		if len(items) == fit {
+			break
+		}
+		if item.Image == nil && settings.ExcludeNullImages {
+			continue
+		}
+		entry := shareItem{Rank: item.Rank, Name: item.Name}
+		if item.Image != nil {
+			entry.ImageURL = item.Image.URL
+		}
+		var artists []string
+		for _, artist := range item.Artists {
+			artists = append(artists, artist.Name)
+		}
+		entry.Artists = strings.Join(artists, ", ")
+		items = append(items, entry)
+	}
+	return items, nil
+}
+
+// the caller's shares
+func handleListShares(w http.ResponseWriter, r *http.Request) {
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+	owned, err := shares.ListOwnedBy(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing shares for %s: %v", userID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching shares")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, owned)
+}
+
+// delete one of the caller's shares, the link stops working straight away
+func handleDeleteShare(w http.ResponseWriter, r *http.Request) {
+	userID, ok := preferencesUser(w, r)
+	if !ok {
+		return
+	}
+	share, err := shares.Get(r.Context(), r.PathValue("id"))
+	if err == nil && share.OwnerID != userID {
+		err = errShareNotFound
+	}
+	if errors.Is(err, errShareNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "No such share")
+		return
+	}
+	if err == nil {
+		_, err = shares.Delete(r.Context(), share.ID)
+	}
+	if err != nil {
+		log.Printf("Error deleting share: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error deleting share")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// the public permalink, /w/{id}.png is always the image, /w/{id} is the HTML page unless the client asks for an image
+// and not HTML, link preview crawlers often send */* or no Accept at all and need the page to find the card tags, while
+// an <img> pointed at the link asks for image/* and still gets the PNG
+func handleShareLink(w http.ResponseWriter, r *http.Request) {
+	id, wantImage := strings.CutSuffix(r.PathValue("id"), ".png")
+	w.Header().Set("Vary", "Accept")
+
+	share, err := shares.Get(r.Context(), id)
+	if errors.Is(err, errShareNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "This wallpaper doesn't exist or was deleted")
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching share %s: %v", id, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error fetching wallpaper")
+		return
+	}
+
+	if !wantImage && !acceptsOnlyImage(r.Header.Get("Accept")) {
+		serveSharePage(w, share)
+		return
+	}
+	serveShareImage(w, r, share)
+}
+
+// whether an Accept header names an image type and not HTML, browsers navigating list both
+func acceptsOnlyImage(accept string) bool {
+	return strings.Contains(accept, "image/") && !strings.Contains(accept, "text/html")
+}
+
+func serveShareImage(w http.ResponseWriter, r *http.Request, share *Share) {
+	// a share never changes, but it can be deleted, so caches only hold it as long as the share page and then check back
+	// with the ETag, which is cheap since the lookup happens before any rendering
+	etag := `"share-` + share.ID + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data, ok := shareRenders.Get(share.ID)
+	if !ok {
+		img, err := renderWallpaper(r.Context(), shareWallpaper(share))
+		if err == nil {
+			data, err = encodePNG(img)
+		}
+		if err != nil {
+			log.Printf("Error rendering share %s: %v", share.ID, err)
+			w.Header().Del("ETag")
+			w.Header().Set("Cache-Control", "no-store")
+			writeError(w, http.StatusInternalServerError, "internal_error", "Error rendering wallpaper")
+			return
+		}
+		shareRenders.Add(share.ID, data)
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+func shareWallpaper(share *Share) *wallpaper {
+	urls := make([]string, len(share.Items))
+	for i, item := range share.Items {
+		urls[i] = item.ImageURL
+	}
+	return gridWallpaper(&share.Settings, urls, share.ProfilePictureURL)
+}
+
+var sharePage = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<meta name="description" content="{{.Description}}">
+<meta property="og:type" content="website">
+<meta property="og:site_name" content="Wallify">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.URL}}">
+<meta property="og:image" content="{{.ImageURL}}">
+<meta property="og:image:type" content="image/png">
+<meta property="og:image:width" content="{{.Width}}">
+<meta property="og:image:height" content="{{.Height}}">
+<meta name="twitter:card" content="summary_large_image">
+<meta name="twitter:title" content="{{.Title}}">
+<meta name="twitter:description" content="{{.Description}}">
+<meta name="twitter:image" content="{{.ImageURL}}">
+<style>
+body { margin: 0; min-height: 100vh; display: flex; flex-direction: column; align-items: center; justify-content: center; gap: 24px; background: #121212; color: #fff; font-family: sans-serif; }
+img { max-width: 95vw; max-height: 80vh; }
+a { color: #1ed760; }
+</style>
+</head>
+<body>
+<img src="{{.ImageURL}}" alt="{{.Description}}">
+<a href="{{.AppURL}}">Make your own on Wallify</a>
+</body>
+</html>
+`))
+
+func serveSharePage(w http.ResponseWriter, share *Share) {
+	names := []string{}
+	for _, item := range share.Items[:min(3, len(share.Items))] {
+		names = append(names, fmt.Sprintf("%d. %s", item.Rank, item.Name))
+	}
+	description := strings.Join(names, ", ")
+	if more := len(share.Items) - len(names); more > 0 {
+		description += fmt.Sprintf(" and %d more", more)
+	}
+
+	layout := shareWallpaper(share)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	err := sharePage.Execute(w, map[string]interface{}{
+		"Title":       fmt.Sprintf("Top %s on Wallify", share.ContentType),
+		"Description": description,
+		"URL":         share.URL,
+		"ImageURL":    share.URL + ".png",
+		"Width":       layout.Width,
+		"Height":      layout.Height,
+		"AppURL":      "https://wallify.doypid.com",
+	})
+	if err != nil {
+		log.Printf("Error writing share page %s: %v", share.ID, err)
+	}
+}
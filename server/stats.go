@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// running counters kept in their own table, one item per counter, i.e. users#country#US
+// counts are bumped atomically with ADD so concurrent logins never lose an increment, and reading them back for the
+// admin stats is a scan of this small table instead of the users and tokens tables
+//
+// counter families, days are UTC dates and weeks ISO weeks:
+//   users#total                      registered users, down again when a user deletes their data
+//   users#new#day#2026-10-19         new users per day, and users#new#week#2026-W42 per week
+//   users#deleted#day#2026-10-19     users that deleted their data per day
+//   users#country#US                 registrations per country
+//   users#product#premium            registrations per subscription tier
+//   logins#returning#day#2026-10-19  logins by existing users per day, and logins#returning#week#2026-W42 per week
+//   sessions#active#day#2026-10-19   sessions that made an authenticated request per day
+//
+// the per country and per tier counts are registrations, they don't go down on deletion since privacy mode doesn't
+// keep the country to take it back off again, for the same reason they're the only record of those users' countries
+
+type statsStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+var stats *statsStore
+
+func (s *statsStore) Add(ctx context.Context, statID string, delta int64) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"StatID": &types.AttributeValueMemberS{Value: statID},
+		},
+		UpdateExpression: aws.String("ADD #count :delta"),
+		ExpressionAttributeNames: map[string]string{
+			"#count": "Count", // reserved word in DynamoDB expressions
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":delta": &types.AttributeValueMemberN{Value: strconv.FormatInt(delta, 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error updating counter %s: %w", statID, err)
+	}
+	return nil
+}
+
+// overwrite a counter, only for rebuilding them from the tables
+func (s *statsStore) Set(ctx context.Context, statID string, value int64) error {
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]types.AttributeValue{
+			"StatID": &types.AttributeValueMemberS{Value: statID},
+			"Count":  &types.AttributeValueMemberN{Value: strconv.FormatInt(value, 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error setting counter %s: %w", statID, err)
+	}
+	return nil
+}
+
+// every counter by ID
+func (s *statsStore) List(ctx context.Context) (map[string]int64, error) {
+	counters := make(map[string]int64)
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{TableName: aws.String(s.table)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning counters: %w", err)
+		}
+		for _, item := range page.Items {
+			id, ok := item["StatID"].(*types.AttributeValueMemberS)
+			count, ok2 := item["Count"].(*types.AttributeValueMemberN)
+			if !ok || !ok2 {
+				continue
+			}
+			counters[id.Value], _ = strconv.ParseInt(count.Value, 10, 64)
+		}
+	}
+	return counters, nil
+}
+
+func statDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+func statWeek(t time.Time) string {
+	year, week := t.UTC().ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week)
+}
+
+// bump a set of counters by one each, stats are best effort so failures are only logged
+func countStats(ctx context.Context, delta int64, statIDs ...string) {
+	for _, id := range statIDs {
+		if err := stats.Add(ctx, id, delta); err != nil {
+			log.Printf("Error updating stats: %v", err)
+		}
+	}
+}
+
+func recordNewUser(ctx context.Context, profile *SpotifyProfile, at time.Time) {
+	ids := []string{"users#total", "users#new#day#" + statDay(at), "users#new#week#" + statWeek(at)}
+	if profile.Country != "" {
+		ids = append(ids, "users#country#"+profile.Country)
+	}
+	if profile.Product != "" {
+		ids = append(ids, "users#product#"+profile.Product)
+	}
+	countStats(ctx, 1, ids...)
+}
+
+func recordReturningLogin(ctx context.Context) {
+	now := time.Now()
+	countStats(ctx, 1, "logins#returning#day#"+statDay(now), "logins#returning#week#"+statWeek(now))
+}
+
+func recordUserDeleted(ctx context.Context) {
+	countStats(ctx, -1, "users#total")
+	countStats(ctx, 1, "users#deleted#day#"+statDay(time.Now()))
+}
+
+// count a session as active today, off the request path since it's only bookkeeping
+func recordActiveSession() {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		countStats(ctx, 1, "sessions#active#day#"+statDay(time.Now()))
+	}()
+}
+
+type statCount struct {
+	Period string `json:"period"` // a date, or an ISO week like 2026-W42
+	Count  int64  `json:"count"`
+}
+
+type statsReport struct {
+	From            string           `json:"from"` // first day of the window, inclusive
+	To              string           `json:"to"`
+	Users           int64            `json:"users"`
+	NewUsers        int64            `json:"newUsers"` // within the window
+	DeletedUsers    int64            `json:"deletedUsers"`
+	ReturningLogins int64            `json:"returningLogins"`
+	NewPerDay       []statCount      `json:"newPerDay"`
+	NewPerWeek      []statCount      `json:"newPerWeek"`
+	ReturningPerDay []statCount      `json:"returningPerDay"`
+	ActivePerDay    []statCount      `json:"activeSessionsPerDay"`
+	Countries       map[string]int64 `json:"countries"`
+	Products        map[string]int64 `json:"products"`
+	ActiveNow       *int             `json:"activeSessionsNow,omitempty"` // sessions seen by this server in the last 30 minutes
+}
+
+// put the report for the last days days (today included) together from the counters
+func buildStatsReport(ctx context.Context, days int, now time.Time) (*statsReport, error) {
+	counters, err := stats.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	from := now.UTC().AddDate(0, 0, -(days - 1))
+	report := &statsReport{
+		From:      statDay(from),
+		To:        statDay(now),
+		Users:     counters["users#total"],
+		Countries: map[string]int64{},
+		Products:  map[string]int64{},
+	}
+
+	// every day and week in the window gets an entry, zero or not, so the series can be charted as is
+	lastWeek := ""
+	for day := from; !day.After(now.UTC()); day = day.AddDate(0, 0, 1) {
+		d := statDay(day)
+		report.NewPerDay = append(report.NewPerDay, statCount{d, counters["users#new#day#"+d]})
+		report.ReturningPerDay = append(report.ReturningPerDay, statCount{d, counters["logins#returning#day#"+d]})
+		report.ActivePerDay = append(report.ActivePerDay, statCount{d, counters["sessions#active#day#"+d]})
+		report.NewUsers += counters["users#new#day#"+d]
+		report.DeletedUsers += counters["users#deleted#day#"+d]
+		report.ReturningLogins += counters["logins#returning#day#"+d]
+
+		if w := statWeek(day); w != lastWeek {
+			report.NewPerWeek = append(report.NewPerWeek, statCount{w, counters["users#new#week#"+w]})
+			lastWeek = w
+		}
+	}
+
+	for id, count := range counters {
+		if country, ok := strings.CutPrefix(id, "users#country#"); ok {
+			report.Countries[country] = count
+		} else if product, ok := strings.CutPrefix(id, "users#product#"); ok {
+			report.Products[product] = count
+		}
+	}
+	return report, nil
+}
+
+// parse the ?days= window, 30 days unless asked otherwise, at most a year
+func parseStatsDays(raw string) (int, error) {
+	if raw == "" {
+		return 30, nil
+	}
+	days, err := strconv.Atoi(raw)
+	if err != nil || days < 1 || days > 366 {
+		return 0, fmt.Errorf("days must be between 1 and 366")
+	}
+	return days, nil
+}
+
+// admin route reporting usage over a window, i.e. /admin/stats?days=7
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	days, err := parseStatsDays(r.URL.Query().Get("days"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	report, err := buildStatsReport(r.Context(), days, time.Now())
+	if err != nil {
+		log.Printf("Error building stats: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error building stats")
+		return
+	}
+	activeNow := activeSessions.count()
+	report.ActiveNow = &activeNow
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, report)
+}
+
+// recompute the user counters from the users table, a one-off for users registered before the counters existed
+// countries are counted from the records, but a running count higher than that is kept since it includes users whose
+// record doesn't keep a country (privacy mode), tiers aren't stored so those counts are left alone, as are the login
+// and session counts
+func rebuildUserStats(ctx context.Context) (map[string]int64, error) {
+	list, err := users.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := stats.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	counters := map[string]int64{"users#total": int64(len(list))}
+	for _, user := range list {
+		if user.Country != "" {
+			counters["users#country#"+user.Country]++
+		}
+		if user.CreatedAt != nil {
+			counters["users#new#day#"+statDay(*user.CreatedAt)]++
+			counters["users#new#week#"+statWeek(*user.CreatedAt)]++
+		}
+	}
+	for id, count := range existing {
+		if strings.HasPrefix(id, "users#country#") && count > counters[id] {
+			counters[id] = count
+		}
+	}
+
+	ids := make([]string, 0, len(counters))
+	for id := range counters {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := stats.Set(ctx, id, counters[id]); err != nil {
+			return nil, err
+		}
+	}
+	return counters, nil
+}
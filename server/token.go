@@ -6,12 +6,16 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -20,12 +24,27 @@ import (
 
 type Token struct {
 	TokenID      string
+	UserID       string // Spotify user the session belongs to, empty for sessions created before it was recorded
 	AccessToken  string
 	RefreshToken string
-	Expiration   int64
+	Expiration   int64 // unix time the access token was last issued, set at login and bumped on every refresh
 }
 
-func generateUniqueKey() (string, error) {
+var errTokenNotFound = errors.New("invalid or missing token")
+
+// storage for session tokens, keyed by the token key handed to the client
+// the server uses a cached store in front of DynamoDB, see tokencache.go
+type TokenStore interface {
+	Fetch(ctx context.Context, tokenKey string) (*Token, error) // errTokenNotFound if there's no such session
+	Put(ctx context.Context, token *Token) error
+	UpdateAccessToken(ctx context.Context, tokenKey, newAccessToken string) error
+	Delete(ctx context.Context, tokenKey string) error
+	List(ctx context.Context) ([]*Token, error) // every session, for the admin tooling
+}
+
+var tokens TokenStore
+
+func generateUniqueKey(ctx context.Context) (string, error) {
 	for {
 		// generate a random 16-byte key
 		bytes := make([]byte, 16)
@@ -35,74 +54,201 @@ func generateUniqueKey() (string, error) {
 		}
 		key := hex.EncodeToString(bytes)
 
-		// check if key already exists in DynamoDB
-		result, err := dynamoClient.GetItem(context.TODO(), &dynamodb.GetItemInput{
-			TableName: aws.String(tableName),
-			Key: map[string]types.AttributeValue{
-				"TokenID": &types.AttributeValueMemberS{Value: key},
-			},
-		})
-
-		if err != nil || result.Item == nil {
+		// check if key already exists
+		if _, err := tokens.Fetch(ctx, key); err != nil {
 			return key, nil
 		}
 	}
 }
 
+// the first few characters of a session key or access token, enough to tell sessions apart in logs without handing
+// out a working credential
+func maskToken(token string) string {
+	if len(token) <= 6 {
+		return "..."
+	}
+	return token[:6] + "..."
+}
+
+// the field names of a Spotify token response, for logging one without the tokens in it
+func responseFields(response map[string]interface{}) []string {
+	fields := make([]string, 0, len(response))
+	for field := range response {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// token store backed by the Wallify-Tokens table
+type dynamoTokenStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
 // retrieve a token from dynamo
-func FetchToken(tokenKey string) (*Token, error) {
-	result, err := dynamoClient.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName: aws.String(tableName),
+func (s *dynamoTokenStore) Fetch(ctx context.Context, tokenKey string) (*Token, error) {
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
 		Key: map[string]types.AttributeValue{
 			"TokenID": &types.AttributeValueMemberS{Value: tokenKey},
 		},
 	})
-	if err != nil || result.Item == nil {
-		return nil, fmt.Errorf("invalid or missing token")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching token: %w", err)
+	}
+	if result.Item == nil {
+		return nil, errTokenNotFound
 	}
 
-	accessToken := result.Item["AccessToken"].(*types.AttributeValueMemberS).Value
-	refreshToken := result.Item["RefreshToken"].(*types.AttributeValueMemberS).Value
-	expiration, _ := strconv.ParseInt(result.Item["Expiration"].(*types.AttributeValueMemberN).Value, 10, 64)
+	return tokenFromItem(result.Item), nil
+}
 
-	return &Token{
-		TokenID:      tokenKey,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		Expiration:   expiration,
-	}, nil
+func tokenFromItem(item map[string]types.AttributeValue) *Token {
+	token := &Token{
+		TokenID:      item["TokenID"].(*types.AttributeValueMemberS).Value,
+		AccessToken:  item["AccessToken"].(*types.AttributeValueMemberS).Value,
+		RefreshToken: item["RefreshToken"].(*types.AttributeValueMemberS).Value,
+	}
+	token.Expiration, _ = strconv.ParseInt(item["Expiration"].(*types.AttributeValueMemberN).Value, 10, 64)
+	if userID, ok := item["UserID"].(*types.AttributeValueMemberS); ok {
+		token.UserID = userID.Value
+	}
+	return token
 }
 
-// update the the access token in dynamo
-func UpdateAccessToken(tokenKey, newAccessToken string) error {
-	_, err := dynamoClient.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
-		TableName: aws.String(tableName),
+// store a new token in dynamo
+func (s *dynamoTokenStore) Put(ctx context.Context, token *Token) error {
+	item := map[string]types.AttributeValue{
+		"TokenID":      &types.AttributeValueMemberS{Value: token.TokenID},
+		"AccessToken":  &types.AttributeValueMemberS{Value: token.AccessToken},
+		"RefreshToken": &types.AttributeValueMemberS{Value: token.RefreshToken},
+		"Expiration":   &types.AttributeValueMemberN{Value: strconv.FormatInt(token.Expiration, 10)},
+	}
+	if token.UserID != "" {
+		item["UserID"] = &types.AttributeValueMemberS{Value: token.UserID}
+	}
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+	return err
+}
+
+// update the the access token in dynamo, along with when it was issued so idle sessions can be told apart
+func (s *dynamoTokenStore) UpdateAccessToken(ctx context.Context, tokenKey, newAccessToken string) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
 		Key: map[string]types.AttributeValue{
 			"TokenID": &types.AttributeValueMemberS{Value: tokenKey},
 		},
-		UpdateExpression: aws.String("SET AccessToken = :newToken"),
+		UpdateExpression: aws.String("SET AccessToken = :newToken, Expiration = :issued"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":newToken": &types.AttributeValueMemberS{Value: newAccessToken},
+			":issued":   &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+	})
+	return err
+}
+
+// remove a token from dynamo, i.e. on logout
+func (s *dynamoTokenStore) Delete(ctx context.Context, tokenKey string) error {
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"TokenID": &types.AttributeValueMemberS{Value: tokenKey},
 		},
 	})
 	return err
 }
 
-func refreshAccessToken(refreshToken string) (string, error) {
-	log.Println("Attempting to refresh access token for refresh token:", refreshToken)
+// scan every session, fine at this scale and only used by the admin tooling
+func (s *dynamoTokenStore) List(ctx context.Context) ([]*Token, error) {
+	var list []*Token
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{TableName: aws.String(s.table)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning tokens: %w", err)
+		}
+		for _, item := range page.Items {
+			list = append(list, tokenFromItem(item))
+		}
+	}
+	return list, nil
+}
+
+// per-session locks for refreshing, a page load fires several Spotify requests at once and when the access token has
+// expired they all get a 401 together, only the first should go to Spotify and the rest should pick up what it got
+var sessionRefreshes = struct {
+	sync.Mutex
+	locks map[string]*refreshLock
+}{locks: map[string]*refreshLock{}}
+
+type refreshLock struct {
+	sync.Mutex
+	waiting int
+}
+
+// a fresh access token for a session whose expired token was rejected, refreshing it only if nobody else already has
+// the stored token is checked once the lock is held, if it's no longer the one that was rejected another request
+// refreshed it in the meantime and that's the one to use
+func refreshSession(ctx context.Context, tokenKey, rejected string) (string, error) {
+	sessionRefreshes.Lock()
+	lock := sessionRefreshes.locks[tokenKey]
+	if lock == nil {
+		lock = &refreshLock{}
+		sessionRefreshes.locks[tokenKey] = lock
+	}
+	lock.waiting++
+	sessionRefreshes.Unlock()
+
+	lock.Lock()
+	defer func() {
+		lock.Unlock()
+		sessionRefreshes.Lock()
+		lock.waiting--
+		if lock.waiting == 0 {
+			delete(sessionRefreshes.locks, tokenKey)
+		}
+		sessionRefreshes.Unlock()
+	}()
+
+	token, err := tokens.Fetch(ctx, tokenKey)
+	if err != nil {
+		return "", err
+	}
+	if token.AccessToken != rejected {
+		return token.AccessToken, nil
+	}
+
+	newAccessToken, err := refreshAccessToken(ctx, token.RefreshToken)
+	if err != nil {
+		tokenRefreshes.inc("failure")
+		return "", fmt.Errorf("error refreshing access token: %w", err)
+	}
+	tokenRefreshes.inc("success")
+
+	if err := tokens.UpdateAccessToken(ctx, tokenKey, newAccessToken); err != nil {
+		return "", fmt.Errorf("error updating access token in DynamoDB: %w", err)
+	}
+	return newAccessToken, nil
+}
+
+func refreshAccessToken(ctx context.Context, refreshToken string) (string, error) {
+	log.Println("Attempting to refresh access token for refresh token:", maskToken(refreshToken))
 	data := url.Values{}
 	data.Set("grant_type", "refresh_token")
 	data.Set("refresh_token", refreshToken)
 
-	req, err := http.NewRequest("POST", "https://accounts.spotify.com/api/token", bytes.NewBufferString(data.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://accounts.spotify.com/api/token", bytes.NewBufferString(data.Encode()))
 	if err != nil {
 		return "", fmt.Errorf("error creating request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.SetBasicAuth(clientId, clientSecret)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := spotifyClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("error sending token request: %w", err)
 	}
@@ -119,7 +265,7 @@ func refreshAccessToken(refreshToken string) (string, error) {
 		return "", fmt.Errorf("error parsing response JSON: %w", err)
 	}
 
-	if accessToken, exists := responseData["AccessToken"].(string); exists {
+	if accessToken, exists := responseData["access_token"].(string); exists {
 		log.Println("Access token refreshed successfully")
 		return accessToken, nil
 	}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// short-lived in-process cache in front of a TokenStore
+// a page load fires three authenticated requests at once and each one looks up the same token, this turns that into
+// a single DynamoDB read, writes through the cache drop the cached copy straight away so a refreshed or revoked token
+// is never served stale
+// a lookup that misses reads the store without holding the lock, so a write can land while it's in flight, every write
+// bumps the key's generation and the lookup only caches what it read if the generation is the same as when it started
+type cachedTokenStore struct {
+	next       TokenStore
+	ttl        time.Duration
+	maxEntries int
+
+	mu       sync.Mutex
+	lru      *list.List // front is most recently used
+	entries  map[string]*list.Element
+	inflight map[string]*tokenLookups
+}
+
+// generations are only kept for keys with a lookup in flight, a write to any other key has nothing to race with, so
+// the map stays as small as the number of concurrent misses
+type tokenLookups struct {
+	generation uint64
+	pending    int
+}
+
+type cachedToken struct {
+	token   Token
+	expires time.Time
+}
+
+func newCachedTokenStore(next TokenStore, ttl time.Duration, maxEntries int) *cachedTokenStore {
+	return &cachedTokenStore{
+		next:       next,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+		inflight:   make(map[string]*tokenLookups),
+	}
+}
+
+func (c *cachedTokenStore) Fetch(ctx context.Context, tokenKey string) (*Token, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[tokenKey]; ok {
+		entry := el.Value.(*cachedToken)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(el)
+			token := entry.token // callers get their own copy
+			c.mu.Unlock()
+			tokenCacheRequests.inc("hit")
+			return &token, nil
+		}
+		c.remove(el)
+	}
+	lookups := c.inflight[tokenKey]
+	if lookups == nil {
+		lookups = &tokenLookups{}
+		c.inflight[tokenKey] = lookups
+	}
+	lookups.pending++
+	started := lookups.generation
+	c.mu.Unlock()
+	tokenCacheRequests.inc("miss")
+
+	// misses aren't cached, an unknown key should cost a lookup every time rather than sit in memory
+	token, err := c.next.Fetch(ctx, tokenKey)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lookups.pending--
+	if lookups.pending == 0 {
+		delete(c.inflight, tokenKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a write since the lookup started means what it read may already be stale, hand it back but don't keep it
+	if lookups.generation != started {
+		return token, nil
+	}
+	if el, ok := c.entries[tokenKey]; ok {
+		c.remove(el)
+	}
+	c.entries[tokenKey] = c.lru.PushFront(&cachedToken{token: *token, expires: time.Now().Add(c.ttl)})
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+
+	return token, nil
+}
+
+// writes invalidate before and after, the first drops the cached copy and stops lookups already in flight from caching
+// the old token, the second stops any lookup that started while the write was still going
+
+func (c *cachedTokenStore) Put(ctx context.Context, token *Token) error {
+	c.invalidate(token.TokenID)
+	defer c.invalidate(token.TokenID)
+	return c.next.Put(ctx, token)
+}
+
+func (c *cachedTokenStore) UpdateAccessToken(ctx context.Context, tokenKey, newAccessToken string) error {
+	c.invalidate(tokenKey)
+	defer c.invalidate(tokenKey)
+	return c.next.UpdateAccessToken(ctx, tokenKey, newAccessToken)
+}
+
+func (c *cachedTokenStore) Delete(ctx context.Context, tokenKey string) error {
+	c.invalidate(tokenKey)
+	defer c.invalidate(tokenKey)
+	return c.next.Delete(ctx, tokenKey)
+}
+
+// listing always goes to the store, it's for the admin tooling and shouldn't churn the cache
+func (c *cachedTokenStore) List(ctx context.Context) ([]*Token, error) {
+	return c.next.List(ctx)
+}
+
+func (c *cachedTokenStore) invalidate(tokenKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[tokenKey]; ok {
+		c.remove(el)
+	}
+	if lookups, ok := c.inflight[tokenKey]; ok {
+		lookups.generation++
+	}
+}
+
+// caller holds the lock
+func (c *cachedTokenStore) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cachedToken).token.TokenID)
+}
@@ -3,10 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -19,44 +23,52 @@ type SpotifyProfile struct {
 	DisplayName string `json:"display_name"`
 	Email       string `json:"email"`
 	Country     string `json:"country"`
+	Product     string `json:"product"` // subscription tier, i.e. premium or free
 }
 
-func processUser(accessToken string) error {
+// record the login in the users table, returning the profile so the session can be tied to the user
+func processUser(ctx context.Context, accessToken string) (*SpotifyProfile, error) {
 	// fetch the user profile from Spotify
-	userProfile, err := fetchSpotifyProfile(accessToken)
+	userProfile, err := fetchSpotifyProfile(ctx, accessToken)
 	if err != nil {
-		return fmt.Errorf("error fetching user profile: %w", err)
+		return nil, fmt.Errorf("error fetching user profile: %w", err)
 	}
 
 	// check if the user already exists in the users table
-	userExists, err := checkIfUserExists(userProfile.ID)
-	if err != nil {
-		return fmt.Errorf("error checking if user exists in DynamoDB: %w", err)
+	_, err = users.Get(ctx, userProfile.ID)
+	userExists := err == nil
+	if err != nil && !errors.Is(err, errUserNotFound) {
+		return nil, fmt.Errorf("error checking if user exists in DynamoDB: %w", err)
 	}
 
 	// if the user does not exist, store the user in the users table
 	if userExists {
-		log.Printf("User already exists in DynamoDB: ID=%s, DisplayName=%s, Email=%s, Country=%s",
-			userProfile.ID, userProfile.DisplayName, userProfile.Email, userProfile.Country)
+		userLogins.inc("returning")
+		recordReturningLogin(ctx)
+		log.Printf("User already exists in DynamoDB: %s", describeProfile(userProfile))
 	} else {
-		err = storeUserInDynamo(userProfile)
+		now := time.Now().UTC()
+		user := userFromProfile(userProfile)
+		user.CreatedAt = &now
+		err = users.Put(ctx, user)
 		if err != nil {
-			return fmt.Errorf("error storing user in DynamoDB: %w", err)
+			return nil, fmt.Errorf("error storing user in DynamoDB: %w", err)
 		}
-		log.Printf("New user added to DynamoDB: ID=%s, DisplayName=%s, Email=%s, Country=%s",
-			userProfile.ID, userProfile.DisplayName, userProfile.Email, userProfile.Country)
+		// counted from the profile, so privacy mode not keeping the country on the user still leaves it in the stats
+		recordNewUser(ctx, userProfile, now)
+		userLogins.inc("new")
+		log.Printf("New user added to DynamoDB: %s", describeProfile(userProfile))
 	}
 
-	return nil
+	return userProfile, nil
 }
 
 // fetch user profile from Spotify
-func fetchSpotifyProfile(accessToken string) (*SpotifyProfile, error) {
-	req, _ := http.NewRequest("GET", "https://api.spotify.com/v1/me", nil)
+func fetchSpotifyProfile(ctx context.Context, accessToken string) (*SpotifyProfile, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://api.spotify.com/v1/me", nil)
 	req.Header.Set("Authorization", "Bearer "+accessToken)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := spotifyClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -68,12 +80,18 @@ func fetchSpotifyProfile(accessToken string) (*SpotifyProfile, error) {
 		return nil, err
 	}
 
+	// users missing from the Development Mode allowlist get a 403 here, parseSpotifyError maps that to errNotAllowlisted
+	if resp.StatusCode != http.StatusOK {
+		return nil, parseSpotifyError(resp.StatusCode, bodyBytes)
+	}
+
 	// parse the body into the expected struct
 	var profile struct {
 		ID          string `json:"id"`
 		DisplayName string `json:"display_name"`
 		Email       string `json:"email"`
 		Country     string `json:"country"`
+		Product     string `json:"product"`
 	}
 
 	err = json.Unmarshal(bodyBytes, &profile)
@@ -86,43 +104,343 @@ func fetchSpotifyProfile(accessToken string) (*SpotifyProfile, error) {
 		DisplayName: profile.DisplayName,
 		Email:       profile.Email,
 		Country:     profile.Country,
+		Product:     profile.Product,
 	}
 
 	return userProfile, nil
 }
 
-// check if user already exists the users table
-func checkIfUserExists(userID string) (bool, error) {
-	// query dynamo for user with userID
-	result, err := dynamoClient.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName: aws.String("Wallify-Users"),
+// a registered user, as stored in the users table
+type User struct {
+	ID          string     `json:"id"`
+	DisplayName string     `json:"displayName"`
+	Email       string     `json:"email,omitempty"`
+	EmailHash   string     `json:"emailHash,omitempty"` // keyed hash kept instead of the email in privacy mode
+	Country     string     `json:"country,omitempty"`
+	CreatedAt   *time.Time `json:"createdAt,omitempty"` // missing for users stored before it was recorded
+}
+
+var errUserNotFound = errors.New("user not found")
+
+// storage for registered users, keyed by Spotify user ID
+// shared by the server and the admin commands, see admincli.go
+type UserStore interface {
+	Get(ctx context.Context, userID string) (*User, error) // errUserNotFound if there's no such user
+	Put(ctx context.Context, user *User) error
+	Delete(ctx context.Context, userID string) error
+	List(ctx context.Context) ([]*User, error)
+
+	// saved grid preferences live on the user's record, nil if they haven't saved any
+	GetPreferences(ctx context.Context, userID string) (*Preferences, error)
+	PutPreferences(ctx context.Context, userID string, prefs *Preferences) error // errUserNotFound if there's no such user
+}
+
+var users UserStore
+
+// user store backed by the Wallify-Users table
+type dynamoUserStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func (s *dynamoUserStore) Get(ctx context.Context, userID string) (*User, error) {
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
 		Key: map[string]types.AttributeValue{
 			"UserID": &types.AttributeValueMemberS{Value: userID},
 		},
 	})
-
 	if err != nil {
-		return false, err
+		return nil, fmt.Errorf("error fetching user: %w", err)
+	}
+	if result.Item == nil {
+		return nil, errUserNotFound
+	}
+	return userFromItem(result.Item), nil
+}
+
+// write the profile fields, anything empty is removed (privacy mode drops fields from existing users)
+// it's an update rather than a put so whatever else lives on the record, i.e. preferences, is left alone
+func (s *dynamoUserStore) Put(ctx context.Context, user *User) error {
+	var set, remove []string
+	values := map[string]types.AttributeValue{}
+	for _, field := range []struct{ name, value string }{
+		{"Username", user.DisplayName},
+		{"Email", user.Email},
+		{"EmailHash", user.EmailHash},
+		{"Country", user.Country},
+	} {
+		if field.value == "" {
+			remove = append(remove, field.name)
+			continue
+		}
+		set = append(set, field.name+" = :"+field.name)
+		values[":"+field.name] = &types.AttributeValueMemberS{Value: field.value}
+	}
+	if user.CreatedAt != nil {
+		set = append(set, "CreatedAt = :CreatedAt")
+		values[":CreatedAt"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(user.CreatedAt.Unix(), 10)}
+	}
+
+	expr := ""
+	if len(set) > 0 {
+		expr += "SET " + strings.Join(set, ", ") + " "
+	}
+	if len(remove) > 0 {
+		expr += "REMOVE " + strings.Join(remove, ", ")
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"UserID": &types.AttributeValueMemberS{Value: user.ID},
+		},
+		UpdateExpression: aws.String(strings.TrimSpace(expr)),
 	}
+	if len(values) > 0 {
+		input.ExpressionAttributeValues = values
+	}
+	_, err := s.client.UpdateItem(ctx, input)
+	return err
+}
 
-	return result.Item != nil, nil
+func (s *dynamoUserStore) Delete(ctx context.Context, userID string) error {
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"UserID": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	return err
 }
 
-// store the user in the users table
-func storeUserInDynamo(profile *SpotifyProfile) error {
-	// create an item for the new user
-	item := map[string]types.AttributeValue{
-		"UserID":   &types.AttributeValueMemberS{Value: profile.ID},
-		"Username": &types.AttributeValueMemberS{Value: profile.DisplayName},
-		"Email":    &types.AttributeValueMemberS{Value: profile.Email},
-		"Country":  &types.AttributeValueMemberS{Value: profile.Country},
+// scan every user, the Development Mode cap keeps this tiny
+func (s *dynamoUserStore) List(ctx context.Context) ([]*User, error) {
+	var list []*User
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{TableName: aws.String(s.table)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning users: %w", err)
+		}
+		for _, item := range page.Items {
+			list = append(list, userFromItem(item))
+		}
 	}
+	return list, nil
+}
 
-	// insert the user into the users table
-	_, err := dynamoClient.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String("Wallify-Users"),
-		Item:      item,
+func (s *dynamoUserStore) GetPreferences(ctx context.Context, userID string) (*Preferences, error) {
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"UserID": &types.AttributeValueMemberS{Value: userID},
+		},
+		ProjectionExpression: aws.String("UserID, Preferences"),
 	})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching preferences: %w", err)
+	}
+	if result.Item == nil {
+		return nil, errUserNotFound
+	}
+	doc, ok := result.Item["Preferences"].(*types.AttributeValueMemberS)
+	if !ok {
+		return nil, nil
+	}
+	return decodePreferences(doc.Value)
+}
 
+func (s *dynamoUserStore) PutPreferences(ctx context.Context, userID string, prefs *Preferences) error {
+	doc, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"UserID": &types.AttributeValueMemberS{Value: userID},
+		},
+		UpdateExpression:    aws.String("SET Preferences = :prefs"),
+		ConditionExpression: aws.String("attribute_exists(UserID)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefs": &types.AttributeValueMemberS{Value: string(doc)},
+		},
+	})
+	var missing *types.ConditionalCheckFailedException
+	if errors.As(err, &missing) {
+		return errUserNotFound
+	}
 	return err
 }
+
+func userFromItem(item map[string]types.AttributeValue) *User {
+	user := &User{}
+	if v, ok := item["UserID"].(*types.AttributeValueMemberS); ok {
+		user.ID = v.Value
+	}
+	if v, ok := item["Username"].(*types.AttributeValueMemberS); ok {
+		user.DisplayName = v.Value
+	}
+	if v, ok := item["Email"].(*types.AttributeValueMemberS); ok {
+		user.Email = v.Value
+	}
+	if v, ok := item["EmailHash"].(*types.AttributeValueMemberS); ok {
+		user.EmailHash = v.Value
+	}
+	if v, ok := item["Country"].(*types.AttributeValueMemberS); ok {
+		user.Country = v.Value
+	}
+	if v, ok := item["CreatedAt"].(*types.AttributeValueMemberN); ok {
+		seconds, _ := strconv.ParseInt(v.Value, 10, 64)
+		createdAt := time.Unix(seconds, 0).UTC()
+		user.CreatedAt = &createdAt
+	}
+	return user
+}
+
+// email identities (see privacy.go) of every registered user, to match waitlist entries against, and how many users
+// there are, which is what the Development Mode slots count since users without an email identity still take one
+func listUserEmailIdentities(ctx context.Context) (map[string]bool, int, error) {
+	list, err := users.List(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	identities := make(map[string]bool, len(list))
+	for _, user := range list {
+		if identity := user.emailIdentity(); identity != "" {
+			identities[identity] = true
+		}
+	}
+	return identities, len(list), nil
+}
+
+// what deleting a user removed
+type userDeletion struct {
+	UserID          string `json:"userId"`
+	Sessions        int    `json:"sessions"`
+	WaitlistEntries int    `json:"waitlistEntries"`
+	Presets         int    `json:"presets"`
+	Shares          int    `json:"shares"`
+	Feeds           int    `json:"feeds"`
+}
+
+// remove everything stored about a user, their record, every session, any waitlist entry, their presets, shares and feeds, with an audit entry when it
+// starts and another with what was removed once it's done
+// actor is who asked for it, self or admin, extraSession is a session to end even if it isn't tied to the user yet
+// (sessions from before tokens recorded their user)
+// images in the proxy cache are shared Spotify CDN artwork rather than anything about the user, so they stay
+func deleteUserData(ctx context.Context, user *User, actor, extraSession string) (*userDeletion, error) {
+	deletion := &userDeletion{UserID: user.ID}
+
+	// the counters only change for users that were actually registered
+	_, err := users.Get(ctx, user.ID)
+	if err != nil && !errors.Is(err, errUserNotFound) {
+		return nil, err
+	}
+	existed := err == nil
+
+	// the request is on record before anything goes, so a deletion that can't be audited doesn't happen and one that
+	// fails partway through still leaves a trace
+	err = audit.Record(ctx, auditEntry{Action: "user.deletion_started", Actor: actor, Subject: user.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := tokens.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range sessions {
+		if token.UserID != user.ID && token.TokenID != extraSession {
+			continue
+		}
+		if err := tokens.Delete(ctx, token.TokenID); err != nil {
+			return nil, fmt.Errorf("error deleting session: %w", err)
+		}
+		activeSessions.forget(token.TokenID)
+		deletion.Sessions++
+	}
+
+	entries, err := waitlistEntriesFor(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		removed, err := waitlist.Delete(ctx, entry.Email)
+		if err != nil {
+			return nil, err
+		}
+		if removed {
+			deletion.WaitlistEntries++
+		}
+	}
+
+	owned, err := presetsOwnedBy(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, preset := range owned {
+		removed, err := presets.Delete(ctx, preset.ID)
+		if err != nil {
+			return nil, err
+		}
+		if removed {
+			deletion.Presets++
+		}
+	}
+
+	shared, err := shares.ListOwnedBy(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, share := range shared {
+		removed, err := shares.Delete(ctx, share.ID)
+		if err != nil {
+			return nil, err
+		}
+		if removed {
+			deletion.Shares++
+		}
+	}
+
+	// feed sessions carry the user ID so they're already gone with the rest, this clears the feeds themselves
+	devices, err := feeds.ListOwnedBy(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, feed := range devices {
+		removed, err := feeds.Delete(ctx, feed)
+		if err != nil {
+			return nil, err
+		}
+		if removed {
+			deletion.Feeds++
+		}
+	}
+
+	if err := users.Delete(ctx, user.ID); err != nil {
+		return nil, fmt.Errorf("error deleting user: %w", err)
+	}
+
+	if existed {
+		recordUserDeleted(ctx)
+	}
+
+	err = audit.Record(ctx, auditEntry{
+		Action:  "user.deleted",
+		Actor:   actor,
+		Subject: user.ID,
+		Details: map[string]string{
+			"sessions":        strconv.Itoa(deletion.Sessions),
+			"waitlistEntries": strconv.Itoa(deletion.WaitlistEntries),
+			"presets":         strconv.Itoa(deletion.Presets),
+			"shares":          strconv.Itoa(deletion.Shares),
+			"feeds":           strconv.Itoa(deletion.Feeds),
+		},
+	})
+	if err != nil {
+		// the data is already gone and user.deletion_started is on record, so the deletion still counts
+		log.Printf("User %s deleted by %s but the completed audit entry failed: %v", user.ID, actor, err)
+	}
+	return deletion, nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// access waitlist for while the Spotify app is in Development Mode
+// Spotify only serves users that were added by hand on the developer dashboard, capped at 25, so people ask for access here
+// and get approved from the admin routes, which hand back the name and email to paste into the dashboard
+
+const (
+	waitlistPending  = "pending"
+	waitlistApproved = "approved"
+	waitlistRejected = "rejected"
+)
+
+var errWaitlistEntryNotFound = errors.New("waitlist entry not found")
+
+// how many users the Spotify app can have registered, 25 in Development Mode
+var devModeUserLimit = 25
+
+type waitlistEntry struct {
+	Email           string     `json:"email"`
+	SpotifyUsername string     `json:"spotifyUsername"`
+	Status          string     `json:"status"`
+	RequestedAt     time.Time  `json:"requestedAt"`
+	DecidedAt       *time.Time `json:"decidedAt,omitempty"`
+}
+
+// waitlist entries live in their own table keyed by the lowercased email, so asking twice doesn't queue someone twice
+type waitlistStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+var waitlist *waitlistStore
+
+// add a pending entry, returns false if there already was one for the email
+func (s *waitlistStore) Add(ctx context.Context, entry *waitlistEntry) (bool, error) {
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]types.AttributeValue{
+			"Email":           &types.AttributeValueMemberS{Value: entry.Email},
+			"SpotifyUsername": &types.AttributeValueMemberS{Value: entry.SpotifyUsername},
+			"Status":          &types.AttributeValueMemberS{Value: entry.Status},
+			"RequestedAt":     &types.AttributeValueMemberN{Value: strconv.FormatInt(entry.RequestedAt.Unix(), 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(Email)"),
+	})
+	var exists *types.ConditionalCheckFailedException
+	if errors.As(err, &exists) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// a single entry, nil if nobody asked with that email
+func (s *waitlistStore) Get(ctx context.Context, email string) (*waitlistEntry, error) {
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"Email": &types.AttributeValueMemberS{Value: email},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching waitlist entry: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	return waitlistEntryFromItem(result.Item), nil
+}
+
+// remove an entry, returns false if there wasn't one
+func (s *waitlistStore) Delete(ctx context.Context, email string) (bool, error) {
+	result, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"Email": &types.AttributeValueMemberS{Value: email},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return false, fmt.Errorf("error deleting waitlist entry: %w", err)
+	}
+	return result.Attributes != nil, nil
+}
+
+// the entries belonging to a user, matched on the email or, in privacy mode, its hash
+func waitlistEntriesFor(ctx context.Context, user *User) ([]*waitlistEntry, error) {
+	if user.Email != "" {
+		entry, err := waitlist.Get(ctx, strings.ToLower(user.Email))
+		if err != nil || entry == nil {
+			return nil, err
+		}
+		return []*waitlistEntry{entry}, nil
+	}
+	if user.EmailHash == "" {
+		return nil, nil
+	}
+	all, err := waitlist.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*waitlistEntry
+	for _, entry := range all {
+		if emailIdentity(entry.Email) == user.EmailHash {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// every entry, oldest request first, the table stays small enough that a scan is fine
+func (s *waitlistStore) List(ctx context.Context) ([]*waitlistEntry, error) {
+	var entries []*waitlistEntry
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{TableName: aws.String(s.table)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning waitlist: %w", err)
+		}
+		for _, item := range page.Items {
+			entries = append(entries, waitlistEntryFromItem(item))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].RequestedAt.Before(entries[j].RequestedAt) })
+	return entries, nil
+}
+
+// move an entry to approved or rejected, errWaitlistEntryNotFound if nobody asked with that email
+func (s *waitlistStore) Decide(ctx context.Context, email, status string) (*waitlistEntry, error) {
+	result, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"Email": &types.AttributeValueMemberS{Value: email},
+		},
+		UpdateExpression:    aws.String("SET #status = :status, DecidedAt = :decidedAt"),
+		ConditionExpression: aws.String("attribute_exists(Email)"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status", // reserved word in DynamoDB expressions
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status":    &types.AttributeValueMemberS{Value: status},
+			":decidedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	var missing *types.ConditionalCheckFailedException
+	if errors.As(err, &missing) {
+		return nil, errWaitlistEntryNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error updating waitlist entry: %w", err)
+	}
+	return waitlistEntryFromItem(result.Attributes), nil
+}
+
+func waitlistEntryFromItem(item map[string]types.AttributeValue) *waitlistEntry {
+	entry := &waitlistEntry{}
+	if v, ok := item["Email"].(*types.AttributeValueMemberS); ok {
+		entry.Email = v.Value
+	}
+	if v, ok := item["SpotifyUsername"].(*types.AttributeValueMemberS); ok {
+		entry.SpotifyUsername = v.Value
+	}
+	if v, ok := item["Status"].(*types.AttributeValueMemberS); ok {
+		entry.Status = v.Value
+	}
+	if v, ok := item["RequestedAt"].(*types.AttributeValueMemberN); ok {
+		seconds, _ := strconv.ParseInt(v.Value, 10, 64)
+		entry.RequestedAt = time.Unix(seconds, 0).UTC()
+	}
+	if v, ok := item["DecidedAt"].(*types.AttributeValueMemberN); ok {
+		seconds, _ := strconv.ParseInt(v.Value, 10, 64)
+		decidedAt := time.Unix(seconds, 0).UTC()
+		entry.DecidedAt = &decidedAt
+	}
+	return entry
+}
+
+// how the Development Mode slots are being used
+// registered users come from the users table, approved entries that haven't logged in yet hold a slot too since they're
+// (or are about to be) on the dashboard
+type slotUsage struct {
+	Limit      int `json:"limit"`
+	Registered int `json:"registered"`
+	Reserved   int `json:"reserved"`
+	Available  int `json:"available"`
+}
+
+// work out the slot usage, along with the approved entries still waiting to log in
+func waitlistSlots(ctx context.Context, entries []*waitlistEntry) (slotUsage, []*waitlistEntry, error) {
+	identities, registered, err := listUserEmailIdentities(ctx)
+	if err != nil {
+		return slotUsage{}, nil, err
+	}
+
+	var awaiting []*waitlistEntry
+	for _, entry := range entries {
+		if entry.Status == waitlistApproved && !identities[emailIdentity(entry.Email)] {
+			awaiting = append(awaiting, entry)
+		}
+	}
+
+	usage := slotUsage{Limit: devModeUserLimit, Registered: registered, Reserved: len(awaiting)}
+	usage.Available = max(0, usage.Limit-usage.Registered-usage.Reserved)
+	return usage, awaiting, nil
+}
+
+type waitlistRequest struct {
+	Email           string `json:"email"`
+	SpotifyUsername string `json:"spotifyUsername"`
+}
+
+// public route for asking for access, answers the same way whether or not the email was already on the list
+func handleWaitlistJoin(w http.ResponseWriter, r *http.Request) {
+	var body waitlistRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Request body must be JSON with an email and spotifyUsername")
+		return
+	}
+
+	email, err := normalizeEmail(body.Email)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_email", "A valid email address is required")
+		return
+	}
+	username := strings.TrimSpace(body.SpotifyUsername)
+	if username == "" || len(username) > 64 {
+		writeError(w, http.StatusBadRequest, "invalid_username", "spotifyUsername must be between 1 and 64 characters")
+		return
+	}
+
+	added, err := waitlist.Add(r.Context(), &waitlistEntry{
+		Email:           email,
+		SpotifyUsername: username,
+		Status:          waitlistPending,
+		RequestedAt:     time.Now(),
+	})
+	if err != nil {
+		log.Printf("Error adding waitlist entry: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error saving your request")
+		return
+	}
+	if added && !privacy.enabled {
+		log.Printf("New waitlist request from %s", username)
+	} else if added {
+		log.Println("New waitlist request")
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"status":  "received",
+		"message": "Thanks! You'll get access once a slot frees up and your request is approved",
+	})
+}
+
+// the dashboard's Users and Access form only needs a name and email, and the Spotify email is the one that matters
+func normalizeEmail(raw string) (string, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(raw))
+	if err != nil || len(addr.Address) > 254 {
+		return "", errors.New("invalid email")
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+// admin route listing the waitlist, optionally filtered with ?status=, along with the slot usage
+func handleWaitlistList(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != "" && status != waitlistPending && status != waitlistApproved && status != waitlistRejected {
+		writeError(w, http.StatusBadRequest, "invalid_status", "status must be pending, approved or rejected")
+		return
+	}
+
+	entries, err := waitlist.List(r.Context())
+	if err != nil {
+		log.Printf("Error listing waitlist: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error listing the waitlist")
+		return
+	}
+	slots, _, err := waitlistSlots(r.Context(), entries)
+	if err != nil {
+		log.Printf("Error counting slots: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error counting registered users")
+		return
+	}
+
+	filtered := []*waitlistEntry{}
+	for _, entry := range entries {
+		if status == "" || entry.Status == status {
+			filtered = append(filtered, entry)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"entries": filtered, "slots": slots})
+}
+
+// the name and email to enter on the Spotify dashboard for an approved entry
+type dashboardUser struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// admin route approving an entry, refused once every slot is taken
+func handleWaitlistApprove(w http.ResponseWriter, r *http.Request) {
+	entries, err := waitlist.List(r.Context())
+	if err != nil {
+		log.Printf("Error listing waitlist: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error listing the waitlist")
+		return
+	}
+	slots, _, err := waitlistSlots(r.Context(), entries)
+	if err != nil {
+		log.Printf("Error counting slots: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error counting registered users")
+		return
+	}
+
+	email := strings.ToLower(r.PathValue("email"))
+	for _, entry := range entries {
+		if entry.Email == email && entry.Status == waitlistApproved {
+			// approving twice is harmless, it just hands back the export again
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"entry": entry, "dashboard": dashboardUser{entry.SpotifyUsername, entry.Email}, "slots": slots,
+			})
+			return
+		}
+	}
+	if slots.Available == 0 {
+		writeError(w, http.StatusConflict, "no_slots", fmt.Sprintf("All %d Development Mode slots are in use", slots.Limit))
+		return
+	}
+
+	entry, ok := decideWaitlistEntry(w, r, email, waitlistApproved)
+	if !ok {
+		return
+	}
+	slots.Reserved++
+	slots.Available--
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"entry": entry, "dashboard": dashboardUser{entry.SpotifyUsername, entry.Email}, "slots": slots,
+	})
+}
+
+// admin route rejecting an entry
+func handleWaitlistReject(w http.ResponseWriter, r *http.Request) {
+	entry, ok := decideWaitlistEntry(w, r, strings.ToLower(r.PathValue("email")), waitlistRejected)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"entry": entry})
+}
+
+func decideWaitlistEntry(w http.ResponseWriter, r *http.Request, email, status string) (*waitlistEntry, bool) {
+	entry, err := waitlist.Decide(r.Context(), email, status)
+	if errors.Is(err, errWaitlistEntryNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "No waitlist entry for "+email)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error marking waitlist entry %s: %v", status, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error updating the waitlist entry")
+		return nil, false
+	}
+	if privacy.enabled {
+		log.Printf("Waitlist entry %s", status)
+	} else {
+		log.Printf("Waitlist entry for %s %s", entry.SpotifyUsername, status)
+	}
+	return entry, true
+}
+
+// admin route exporting the approved entries that still need adding on the Spotify dashboard, as CSV (name,email)
+func handleWaitlistExport(w http.ResponseWriter, r *http.Request) {
+	entries, err := waitlist.List(r.Context())
+	if err != nil {
+		log.Printf("Error listing waitlist: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error listing the waitlist")
+		return
+	}
+	_, awaiting, err := waitlistSlots(r.Context(), entries)
+	if err != nil {
+		log.Printf("Error counting slots: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error counting registered users")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="wallify-dashboard-users.csv"`)
+	out := csv.NewWriter(w)
+	out.Write([]string{"name", "email"})
+	for _, entry := range awaiting {
+		out.Write([]string{csvCell(entry.SpotifyUsername), csvCell(entry.Email)})
+	}
+	out.Flush()
+}
+
+// the names and emails come from whoever filled in the waitlist form, so a cell a spreadsheet would read as a formula
+// gets a leading quote to keep it as text
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
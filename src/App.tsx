@@ -1,6 +1,7 @@
 import React, { useState, useEffect, useRef } from "react";
 import Login from "./pages/Login";
-import Options from "./components/Options";
+import axios from "axios";
+import Options, { Preferences } from "./components/Options";
 import TopContent from "./pages/TopContent";
 
 interface GridSize {
@@ -23,6 +24,11 @@ const App: React.FC = () => {
   const [useGradient, setUseGradient] = useState(false);
   const [color1, setColor1] = useState("#ffffff");
   const [color2, setColor2] = useState("#000000");
+  const [layout, setLayout] = useState("grid");
+  const [mosaicSeed, setMosaicSeed] = useState(0);
+  const [order, setOrder] = useState("rank");
+  const [autoBackground, setAutoBackground] = useState(false);
+  const [savedPreferences, setSavedPreferences] = useState<Preferences | null>(null);
 
   // fetch the tokens from the URL parameters and save them to the state
   useEffect(() => {
@@ -49,6 +55,17 @@ const App: React.FC = () => {
     }
   }, []);
 
+  // load the user's saved options once they're logged in, the defaults are fine if this fails
+  useEffect(() => {
+    if (!accessToken) return;
+    axios
+      .get("https://wallify-server.doypid.com/api/v1/preferences", {
+        headers: { "x-token-key": accessToken },
+      })
+      .then((response) => setSavedPreferences(response.data))
+      .catch((error) => console.error("Failed to load preferences:", error));
+  }, [accessToken]);
+
   // gather the user's desired generation options and trigger the grid generation
   const handleOptionsSubmit = (
     type: string,
@@ -57,7 +74,11 @@ const App: React.FC = () => {
     excludeNullImages: boolean,
     useGradient: boolean,
     color1: string,
-    color2: string
+    color2: string,
+    layout: string,
+    mosaicSeed: number,
+    order: string,
+    autoBackground: boolean
   ) => {
     setSelectionType(type);
     setGridSize(size);
@@ -66,7 +87,33 @@ const App: React.FC = () => {
     setUseGradient(useGradient);
     setColor1(color1);
     setColor2(color2);
+    setLayout(layout);
+    setMosaicSeed(mosaicSeed);
+    setOrder(order);
+    setAutoBackground(autoBackground);
     setGenerateGrid(true);
+
+    // remember the options for next time
+    axios
+      .put(
+        "https://wallify-server.doypid.com/api/v1/preferences",
+        {
+          version: 1,
+          selectionType: type,
+          gridSize: size,
+          includeProfilePicture: includePic,
+          excludeNullImages,
+          useGradient,
+          color1,
+          color2,
+          layout,
+          mosaicSeed,
+          order,
+          autoBackground,
+        },
+        { headers: { "x-token-key": accessToken } }
+      )
+      .catch((error) => console.error("Failed to save preferences:", error));
   };
 
   // if the user is not logged in, display the login component, otherwise display the options and the subsequent results after submission
@@ -76,7 +123,7 @@ const App: React.FC = () => {
         <Login />
       ) : (
         <>
-          <Options onSubmit={handleOptionsSubmit} />
+          <Options initialPreferences={savedPreferences} onSubmit={handleOptionsSubmit} />
           {console.log(
             "gridSize",
             gridSize,
@@ -101,6 +148,10 @@ const App: React.FC = () => {
               useGradient={useGradient}
               color1={color1}
               color2={color2}
+              layout={layout}
+              mosaicSeed={mosaicSeed}
+              order={order}
+              autoBackground={autoBackground}
             />
           )}
         </>
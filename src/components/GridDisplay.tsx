@@ -1,6 +1,6 @@
 import React from 'react';
 import '../styles/GridDisplay.css';
-import GridItem from './GridItem';
+import GridItem, { proxiedImageUrl } from './GridItem';
 
 interface GridSize {
   x: number;
@@ -8,10 +8,18 @@ interface GridSize {
 }
 
 interface ContentInstance {
-  images?: { url: string }[];
-  album?: { images: { url: string }[] };
-  external_urls?: { spotify: string };
+  id: string;
   name: string;
+  uri: string;
+  rank: number;
+  images: { url: string; width: number; height: number }[];
+}
+
+interface MosaicTile {
+  rank: number;
+  x: number;
+  y: number;
+  size: number;
 }
 
 interface GridDisplayProps {
@@ -22,9 +30,10 @@ interface GridDisplayProps {
   useGradient: boolean;
   color1: string;
   color2: string;
+  mosaicTiles?: MosaicTile[] | null; // from the server, a plain grid without them
 }
 
-const GridDisplay: React.FC<GridDisplayProps> = ({ content, gridSize, includeProfilePicture, profilePictureUrl, useGradient, color1, color2 }) => {
+const GridDisplay: React.FC<GridDisplayProps> = ({ content, gridSize, includeProfilePicture, profilePictureUrl, useGradient, color1, color2, mosaicTiles }) => {
   // calculate the maximum number of images based on the grid size
   const maxArtists = gridSize.x * gridSize.y;
 
@@ -58,12 +67,28 @@ const GridDisplay: React.FC<GridDisplayProps> = ({ content, gridSize, includePro
   return (
     <div className="grid-wrapper">
       <div className="grid-container" style={backgroundStyle}>
-        {contentToDisplay.map((contentInstance, index) => (
-          <GridItem key={index} contentInstance={contentInstance} defaultImageUrl={defaultImageUrl} />
-        ))}
+        {mosaicTiles
+          ? // each tile takes the item at its rank and spans its cells, ranks past the end of the content are left out
+            mosaicTiles
+              .filter((tile) => tile.rank <= contentToDisplay.length)
+              .map((tile) => (
+                <GridItem
+                  key={tile.rank}
+                  contentInstance={contentToDisplay[tile.rank - 1]}
+                  defaultImageUrl={defaultImageUrl}
+                  size={tile.size}
+                  style={{
+                    gridColumn: `${tile.x + 1} / span ${tile.size}`,
+                    gridRow: `${tile.y + 1} / span ${tile.size}`,
+                  }}
+                />
+              ))
+          : contentToDisplay.map((contentInstance, index) => (
+              <GridItem key={index} contentInstance={contentInstance} defaultImageUrl={defaultImageUrl} />
+            ))}
         {includeProfilePicture && profilePictureUrl && (
           <div className="profile-picture-overlay" style={profilePictureContainerStyle}>
-            <img src={profilePictureUrl} alt="Profile" style={profilePictureStyle} />
+            <img src={proxiedImageUrl(profilePictureUrl, 350)} alt="Profile" style={profilePictureStyle} />
           </div>
         )}
       </div>
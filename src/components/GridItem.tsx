@@ -2,30 +2,47 @@ import React from 'react';
 import '../styles/GridItem.css';
 
 interface ContentInstance {
-  images?: { url: string }[];
-  album?: { images: { url: string }[] };
-  external_urls?: { spotify: string };
+  id: string;
   name: string;
+  uri: string;
+  rank: number;
+  images: { url: string; width: number; height: number }[];
 }
 
+// load Spotify art through the server's image proxy, it answers with CORS headers for the app so html2canvas can draw
+// the images without tainting the download canvas, which the CDN doesn't reliably do
+// width is in pixels, tiles ask for twice their size so the 2x download stays sharp
+// the proxy only serves Spotify's CDN, anything else (i.e. Facebook profile pictures) is loaded as is
+export const proxiedImageUrl = (url: string, width: number) =>
+  url.startsWith('https://i.scdn.co/')
+    ? `https://wallify-server.doypid.com/api/v1/img?url=${encodeURIComponent(url)}&w=${Math.min(width, 2048)}`
+    : url;
+
 interface GridItemProps {
   contentInstance: ContentInstance;
   defaultImageUrl: string;
+  size?: number; // cells spanned each way in a mosaic, 1 in a plain grid
+  style?: React.CSSProperties;
 }
 
-const GridItem: React.FC<GridItemProps> = ({ contentInstance, defaultImageUrl }) => {
+const GridItem: React.FC<GridItemProps> = ({ contentInstance, defaultImageUrl, size = 1, style }) => {
   // check if the contentInstance has images and fall back to the default image if necessary
-  // artists have a direct image property, tracks don't so use the album art instead, need to drill into the album property to access the images
-  const imageUrl = contentInstance?.images?.[0]?.url || contentInstance?.album?.images?.[0]?.url || defaultImageUrl;
+  // the server already swaps in the album art for tracks, so both content types share the same images property
+  const sourceUrl = contentInstance?.images?.[0]?.url;
+
+  // build the open.spotify.com link from the uri, i.e. spotify:artist:<id> -> https://open.spotify.com/artist/<id>
+  const [, kind, id] = contentInstance.uri.split(':');
+  const contentUrl = `https://open.spotify.com/${kind}/${id}`;
 
-  // get the external URL for the artist or track, property location is the same in both response formats
-  const contentUrl = contentInstance?.external_urls?.spotify;
+  // a bigger tile covers the 10px gaps between the cells it spans too
+  const side = size * 100 + (size - 1) * 10;
+  const imageUrl = sourceUrl ? proxiedImageUrl(sourceUrl, side * 2) : defaultImageUrl;
 
   return (
     <div
       className="grid-item"
       onClick={() => window.open(contentUrl, '_blank')} // when clicking on the grid item, open the Spotify URL for that artist/track in a new tab
-      style={{ cursor: 'pointer' }}
+      style={{ cursor: 'pointer', width: side, height: side, ...style }}
     >
       <img src={imageUrl} alt="Grid content" />
       <div className="grid-item-overlay">
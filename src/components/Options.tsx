@@ -1,4 +1,4 @@
-import React, { useState } from 'react';
+import React, { useState, useEffect } from 'react';
 import '../styles/Options.css';
 import html2canvas from 'html2canvas';
 
@@ -7,7 +7,24 @@ interface GridSize {
   y: number;
 }
 
+// the user's saved settings, loaded from the server when they log in
+export interface Preferences {
+  version: number;
+  selectionType: string;
+  gridSize: GridSize;
+  includeProfilePicture: boolean;
+  excludeNullImages: boolean;
+  useGradient: boolean;
+  color1: string;
+  color2: string;
+  layout?: string; // grid or mosaic, older saved settings don't have it
+  mosaicSeed?: number;
+  order?: string; // rank, hue, brightness or cluster
+  autoBackground?: boolean;
+}
+
 interface OptionsProps {
+  initialPreferences?: Preferences | null;
   onSubmit: (
     selectionType: string,
     gridSize: GridSize,
@@ -15,11 +32,15 @@ interface OptionsProps {
     excludeNullImages: boolean,
     useGradient: boolean,
     color1: string,
-    color2: string
+    color2: string,
+    layout: string,
+    mosaicSeed: number,
+    order: string,
+    autoBackground: boolean
   ) => void;
 }
 
-const Options: React.FC<OptionsProps> = ({ onSubmit }) => {
+const Options: React.FC<OptionsProps> = ({ initialPreferences, onSubmit }) => {
   const [selectionType, setSelectionType] = useState<string>('artists');
   const [gridSize, setGridSize] = useState<GridSize>({ x: 3, y: 3 });
   const [includeProfilePicture, setIncludeProfilePicture] = useState<boolean>(false);
@@ -27,8 +48,29 @@ const Options: React.FC<OptionsProps> = ({ onSubmit }) => {
   const [color1, setColor1] = useState<string>('#ffffff');
   const [color2, setColor2] = useState<string>('#000000');
   const [excludeNullImages, setExcludeNullImages] = useState<boolean>(false);
+  const [layout, setLayout] = useState<string>('grid');
+  const [mosaicSeed, setMosaicSeed] = useState<number>(0);
+  const [order, setOrder] = useState<string>('rank');
+  const [autoBackground, setAutoBackground] = useState<boolean>(false);
   const [isGridGenerated, setIsGridGenerated] = useState<boolean>(false);
 
+  // start from the saved settings once they arrive
+  useEffect(() => {
+    if (initialPreferences) {
+      setSelectionType(initialPreferences.selectionType);
+      setGridSize(initialPreferences.gridSize);
+      setIncludeProfilePicture(initialPreferences.includeProfilePicture);
+      setExcludeNullImages(initialPreferences.excludeNullImages);
+      setUseGradient(initialPreferences.useGradient);
+      setColor1(initialPreferences.color1);
+      setColor2(initialPreferences.color2);
+      setLayout(initialPreferences.layout || 'grid');
+      setMosaicSeed(initialPreferences.mosaicSeed || 0);
+      setOrder(initialPreferences.order || 'rank');
+      setAutoBackground(initialPreferences.autoBackground || false);
+    }
+  }, [initialPreferences]);
+
   const handleDownload = () => {
     const gridElement = document.querySelector('.grid-container') as HTMLElement;
     if (gridElement) {
@@ -63,7 +105,7 @@ const Options: React.FC<OptionsProps> = ({ onSubmit }) => {
     }
 
     setIsGridGenerated(true);
-    onSubmit(selectionType, gridSize, includeProfilePicture, excludeNullImages, useGradient, color1, color2);
+    onSubmit(selectionType, gridSize, includeProfilePicture, excludeNullImages, useGradient, color1, color2, layout, mosaicSeed, order, autoBackground);
   };
 
   return (
@@ -79,6 +121,17 @@ const Options: React.FC<OptionsProps> = ({ onSubmit }) => {
             </select>
           </label>
         </div>
+        <div>
+          <label>
+            Order Tiles By:
+            <select value={order} onChange={(e) => setOrder(e.target.value)}>
+              <option value="rank">Rank</option>
+              <option value="hue">Rainbow</option>
+              <option value="brightness">Brightness</option>
+              <option value="cluster">Color Groups</option>
+            </select>
+          </label>
+        </div>
         <div className="inline-label">
           <label>
             Grid Size:
@@ -136,7 +189,43 @@ const Options: React.FC<OptionsProps> = ({ onSubmit }) => {
             </label>
           </div>
         </div>
-        {useGradient && (
+        <div className="inline-label">
+          <div className="checkbox-container">
+            <input
+              type="checkbox"
+              checked={layout === 'mosaic'}
+              onChange={() => setLayout(layout === 'mosaic' ? 'grid' : 'mosaic')}
+              id="useMosaic"
+            />
+            <label className="non-clickable" htmlFor="useMosaic">
+              Bigger Tiles for Top Picks
+            </label>
+          </div>
+        </div>
+        {layout === 'mosaic' && (
+          // the seed picks where the big tiles go, the server lays out the same mosaic for the same seed
+          <button
+            type="button"
+            className="shuffle"
+            onClick={() => setMosaicSeed(Math.floor(Math.random() * 2147483647))}
+          >
+            Shuffle Layout
+          </button>
+        )}
+        <div className="inline-label">
+          <div className="checkbox-container">
+            <input
+              type="checkbox"
+              checked={autoBackground}
+              onChange={() => setAutoBackground(!autoBackground)}
+              id="autoBackground"
+            />
+            <label className="non-clickable" htmlFor="autoBackground">
+              Match Background to Artwork
+            </label>
+          </div>
+        </div>
+        {useGradient && !autoBackground && (
           <>
             <div className="color-picker-container">
               <span className="color-label">Color 1:</span>
@@ -1,8 +1,43 @@
 import React, { useState } from 'react';
 import '../styles/Login.css';
 
+// Spotify only lets allowlisted accounts use the app while it's in Development Mode, the server sends everyone else back here
+const notAllowlistedMessage =
+  "Your Spotify account doesn't have access to Wallify yet. Spotify limits new apps to a small list of approved users, request access below and try again once you've been added.";
+
 const Login = () => {
-  const [errorMessage, setErrorMessage] = useState('');
+  const [errorMessage, setErrorMessage] = useState(() => {
+    const params = new URLSearchParams(window.location.search);
+    if (params.get('error') === 'not_allowlisted') {
+      // clear the parameter so a refresh doesn't show the message again
+      window.history.replaceState({}, document.title, '/');
+      return notAllowlistedMessage;
+    }
+    return '';
+  });
+  const [showRequestAccess] = useState(errorMessage === notAllowlistedMessage);
+  const [email, setEmail] = useState('');
+  const [spotifyUsername, setSpotifyUsername] = useState('');
+  const [requestStatus, setRequestStatus] = useState('');
+
+  // join the access waitlist, the email has to be the one on the Spotify account
+  const handleRequestAccess = async (e: React.FormEvent) => {
+    e.preventDefault();
+    setRequestStatus('');
+
+    try {
+      const response = await fetch('https://wallify-server.doypid.com/api/v1/waitlist', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ email, spotifyUsername }),
+      });
+      const data = await response.json();
+      setRequestStatus(data.message);
+    } catch (error) {
+      setRequestStatus('Could not send your request. Please try again later.');
+      console.error('Waitlist request failed:', error);
+    }
+  };
   const [loading, setLoading] = useState(false);
 
   const handleLogin = async () => {
@@ -10,12 +45,12 @@ const Login = () => {
     setErrorMessage('');
 
     try {
-      // Check if the server is reachable
-      const response = await fetch('https://wallify-server.doypid.com/health-check', { method: 'GET' });
+      // Check that the server and the services it depends on (DynamoDB, Spotify) are reachable
+      const response = await fetch('https://wallify-server.doypid.com/api/v1/ready', { method: 'GET' });
 
       if (response.ok) {
         // Server is reachable, proceed with redirect
-        window.location.href = 'https://wallify-server.doypid.com/login';
+        window.location.href = 'https://wallify-server.doypid.com/api/v1/login';
       } else {
         throw new Error('Server response not OK');
       }
@@ -44,6 +79,27 @@ const Login = () => {
         </button>
 
         {errorMessage && <p className="error-message">{errorMessage}</p>}
+
+        {showRequestAccess && (
+          <form onSubmit={handleRequestAccess} className="request-access-form">
+            <input
+              type="email"
+              placeholder="Spotify account email"
+              value={email}
+              onChange={(e) => setEmail(e.target.value)}
+              required
+            />
+            <input
+              type="text"
+              placeholder="Spotify username"
+              value={spotifyUsername}
+              onChange={(e) => setSpotifyUsername(e.target.value)}
+              required
+            />
+            <button type="submit" className="login-button">Request access</button>
+            {requestStatus && <p>{requestStatus}</p>}
+          </form>
+        )}
       </div>
     </>
   );
@@ -17,13 +17,26 @@ interface TopContentProps {
   useGradient: boolean;
   color1: string;
   color2: string;
+  layout: string;
+  mosaicSeed: number;
+  order: string;
+  autoBackground: boolean;
 }
 
 interface ContentInstance {
-  images?: { url: string }[];
-  album?: { images: { url: string }[] };
-  external_urls?: { spotify: string };
+  id: string;
   name: string;
+  uri: string;
+  rank: number;
+  images: { url: string; width: number; height: number }[];
+}
+
+// a mosaic tile from the server, x and y are the grid cell of its top left corner and it spans size cells each way
+interface MosaicTile {
+  rank: number;
+  x: number;
+  y: number;
+  size: number;
 }
 
 // utility to debounce functions, helps avoid making too many requests in quick succession
@@ -44,10 +57,16 @@ const TopContent: React.FC<TopContentProps> = ({
   useGradient,
   color1,
   color2,
+  layout,
+  mosaicSeed,
+  order,
+  autoBackground,
 }) => {
   const [artistsCache, setArtistsCache] = useState<ContentInstance[]>([]);
   const [tracksCache, setTracksCache] = useState<ContentInstance[]>([]);
   const [content, setContent] = useState<ContentInstance[]>([]);
+  const [mosaicTiles, setMosaicTiles] = useState<MosaicTile[] | null>(null);
+  const [background, setBackground] = useState<{ color1: string; color2: string } | null>(null);
   const [profilePictureUrl, setProfilePictureUrl] = useState<string | null>(null);
   const [error, setError] = useState<string | null>(null);
   const [isLoading, setIsLoading] = useState<boolean>(false);
@@ -67,11 +86,21 @@ const TopContent: React.FC<TopContentProps> = ({
       // used cached data if available and complete, otherwise initialize an empty array
       let content: ContentInstance[] = cachedData.length === 99 ? cachedData : [];
   
-      // fetch the data only if the cache is empty
-      if (content.length === 0) {
+      // the server lays out mosaics and sorts by color so the app and server rendered wallpapers match, it needs asking
+      // for every new layout, order or background
+      const mosaic = layout === "mosaic";
+      const byColor = order !== "rank" || autoBackground;
+      const layoutParams = mosaic || byColor ? { layout, columns: gridSize.x, rows: gridSize.y, seed: mosaicSeed } : {};
+      const paletteParams = byColor ? { order, palette: true } : {};
+      let tiles: MosaicTile[] | null = null;
+      let picked: { color1: string; color2: string } | null = null;
+
+      // fetch the data only if the cache is empty or the server needs to lay it out
+      if (content.length === 0 || mosaic || byColor) {
         const response = await axios.get(
-          `https://wallify-server.doypid.com/${contentType}`,
+          `https://wallify-server.doypid.com/api/v1/${contentType}`,
           {
+            params: { limit: 99, ...layoutParams, ...paletteParams },
             headers: {
               "x-token-key": accessToken,
             },
@@ -82,34 +111,39 @@ const TopContent: React.FC<TopContentProps> = ({
 
 
         // check if response is empty, i.e. new user without any listening history
-        if (response.data.length === 0) {
+        if (response.data.items.length === 0) {
           setError(`No ${selectionType} data available. Try again after listening to more music on Spotify.`);
           setIsLoading(false);
           return;
         }
   
         // cache the result so further requests aren't necessary
-        newContent = response.data;
-        if (selectionType === "artists") setArtistsCache(newContent);
-        else setTracksCache(newContent);
+        newContent = response.data.items;
+        if (mosaic) tiles = response.data.layout.tiles;
+        if (autoBackground) picked = response.data.background || null;
+        // color ordered results only suit this order, the cache keeps rank order
+        if (!byColor) {
+          if (selectionType === "artists") setArtistsCache(newContent);
+          else setTracksCache(newContent);
+        }
       }
   
       // optionally filter out results with null or missing images
       if (excludeNullImages) {
         console.log("Excluding null images");
-        newContent = newContent.filter((item) => {
-          const images = selectionType === "artists" ? item.images : item.album?.images;
-          return images && images.length > 0 && images[0].url;
-        });
+        newContent = newContent.filter((item) => item.images.length > 0 && item.images[0].url);
       }
   
       // check if the grid size is larger than the available content, warn if there isnt enough
-      const totalGridItems = gridSize.x * gridSize.y;
+      // a mosaic's bigger tiles cover several cells each so it needs fewer items than cells
+      const totalGridItems = tiles ? tiles.length : gridSize.x * gridSize.y;
       if (newContent.length < totalGridItems) {
         setError(`Only ${newContent.length} ${selectionType} available due to missing images. Please reduce the grid size.`);
       }
   
       setContent(newContent.slice(0, totalGridItems)); // set the content to be displayed based on the grid size and update state
+      setMosaicTiles(tiles);
+      setBackground(picked);
       setIsLoading(false); // set loading to false when data is successfully fetched
     } catch (error) {
       console.error(`Error fetching top ${selectionType}:`, error);
@@ -121,7 +155,7 @@ const TopContent: React.FC<TopContentProps> = ({
         setIsLoading(false); // set loading to false if retries are exhausted
       }
     }
-  }, 500), [accessToken, selectionType, gridSize, excludeNullImages, artistsCache, tracksCache]);
+  }, 500), [accessToken, selectionType, gridSize, excludeNullImages, layout, mosaicSeed, order, autoBackground, artistsCache, tracksCache]);
 
   const fetchProfilePicture = useCallback(async (retryCount: number = 0) => {
     if (profilePictureUrl) {
@@ -130,7 +164,7 @@ const TopContent: React.FC<TopContentProps> = ({
     }
   
     try {
-      const response = await axios.get("https://wallify-server.doypid.com/profile", {
+      const response = await axios.get("https://wallify-server.doypid.com/api/v1/profile", {
         headers: {
           "x-token-key": accessToken,
         },
@@ -177,9 +211,10 @@ const TopContent: React.FC<TopContentProps> = ({
           gridSize={gridSize}
           includeProfilePicture={includeProfilePicture}
           profilePictureUrl={profilePictureUrl}
-          useGradient={useGradient}
-          color1={color1}
-          color2={color2}
+          useGradient={useGradient || background !== null}
+          color1={background ? background.color1 : color1}
+          color2={background ? background.color2 : color2}
+          mosaicTiles={mosaicTiles}
         />
       )}
     </div>